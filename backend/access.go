@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasscodeLength = 4
+	maxPasscodeLength = 72 // bcrypt ignores anything longer
+	defaultInviteTTL  = 7 * 24 * time.Hour
+	inviteSubject     = "meeting-invite"
+)
+
+// Roles an invite can grant
+const (
+	inviteRoleParticipant = "participant"
+	inviteRoleCoHost      = "cohost"
+)
+
+var (
+	errPasscodeRequired = errors.New("this meeting requires a passcode")
+	errInvalidPasscode  = errors.New("incorrect passcode")
+	errPasscodeLength   = errors.New("passcode must be between 4 and 72 characters")
+	errInviteInvalid    = errors.New("invite is invalid or has expired")
+	errInviteRevoked    = errors.New("invite has been revoked")
+	errInviteUsedUp     = errors.New("invite has no uses left")
+)
+
+// Invite lets its holder into a meeting without the passcode or the lobby
+type Invite struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	MeetingID  string             `bson:"meeting_id" json:"meeting_id"`
+	Role       string             `bson:"role" json:"role"`
+	CreatedBy  string             `bson:"created_by" json:"created_by"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expires_at"`
+	MaxUses    int                `bson:"max_uses" json:"max_uses"` // 0 means unlimited
+	Uses       int                `bson:"uses" json:"uses"`
+	RedeemedBy []string           `bson:"redeemed_by" json:"redeemed_by"`
+	Revoked    bool               `bson:"revoked" json:"revoked"`
+}
+
+// InviteClaims is the signed part of an invite link. Uses and revocation
+// live in the database so they can change after the token is handed out.
+type InviteClaims struct {
+	InviteID  string `json:"invite_id"`
+	MeetingID string `json:"meeting_id"`
+	jwt.RegisteredClaims
+}
+
+func hashPasscode(passcode string) (string, error) {
+	if len(passcode) < minPasscodeLength || len(passcode) > maxPasscodeLength {
+		return "", errPasscodeLength
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(passcode), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkAccess lets userID past the passcode, either through an invite or by
+// the passcode itself. Hosts and people who already got in need neither.
+// A redeemed invite is applied to meeting.
+func checkAccess(meeting *Meeting, userID, passcode, inviteToken string) error {
+	if inviteToken != "" {
+		return redeemInvite(meeting, userID, inviteToken)
+	}
+	if meeting.PasscodeHash == "" ||
+		isMeetingHost(meeting, userID) ||
+		containsString(meeting.Participants, userID) ||
+		containsString(meeting.AdmittedUsers, userID) {
+		return nil
+	}
+	if passcode == "" {
+		return errPasscodeRequired
+	}
+	if bcrypt.CompareHashAndPassword([]byte(meeting.PasscodeHash), []byte(passcode)) != nil {
+		return errInvalidPasscode
+	}
+	return nil
+}
+
+func signInvite(invite *Invite) (string, error) {
+	claims := &InviteClaims{
+		InviteID:  invite.ID.Hex(),
+		MeetingID: invite.MeetingID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   inviteSubject,
+			ExpiresAt: jwt.NewNumericDate(invite.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(invite.CreatedAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+func parseInvite(tokenString, meetingID string) (*InviteClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &InviteClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errInviteInvalid
+		}
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errInviteInvalid
+	}
+
+	claims := token.Claims.(*InviteClaims)
+	if claims.Subject != inviteSubject || claims.MeetingID != meetingID {
+		return nil, errInviteInvalid
+	}
+	return claims, nil
+}
+
+// redeemInvite counts one use of an invite by userID and grants what it
+// carries. Redeeming the same invite again is free.
+func redeemInvite(meeting *Meeting, userID, tokenString string) error {
+	claims, err := parseInvite(tokenString, meeting.MeetingID)
+	if err != nil {
+		return err
+	}
+	inviteID, err := primitive.ObjectIDFromHex(claims.InviteID)
+	if err != nil {
+		return errInviteInvalid
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := db.Collection("invites")
+	var invite Invite
+	if err := collection.FindOne(ctx, bson.M{"_id": inviteID}).Decode(&invite); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return errInviteInvalid
+		}
+		return err
+	}
+	if invite.Revoked {
+		return errInviteRevoked
+	}
+	if time.Now().After(invite.ExpiresAt) {
+		return errInviteInvalid
+	}
+
+	if !containsString(invite.RedeemedBy, userID) {
+		// Guarded in the filter so concurrent redemptions cannot exceed max_uses
+		filter := bson.M{
+			"_id":         inviteID,
+			"revoked":     false,
+			"redeemed_by": bson.M{"$ne": userID},
+		}
+		if invite.MaxUses > 0 {
+			filter["uses"] = bson.M{"$lt": invite.MaxUses}
+		}
+		result, err := collection.UpdateOne(ctx, filter, bson.M{
+			"$inc":      bson.M{"uses": 1},
+			"$addToSet": bson.M{"redeemed_by": userID},
+		})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			// Another request may have redeemed it for this user in the meantime
+			var current Invite
+			if err := collection.FindOne(ctx, bson.M{"_id": inviteID}).Decode(&current); err != nil {
+				return err
+			}
+			switch {
+			case current.Revoked:
+				return errInviteRevoked
+			case !containsString(current.RedeemedBy, userID):
+				return errInviteUsedUp
+			}
+		}
+	}
+
+	grant := bson.M{"admitted_users": userID}
+	if invite.Role == inviteRoleCoHost {
+		grant["co_hosts"] = userID
+	}
+	_, err = db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{"$addToSet": grant},
+	)
+	if err != nil {
+		return err
+	}
+
+	if !containsString(meeting.AdmittedUsers, userID) {
+		meeting.AdmittedUsers = append(meeting.AdmittedUsers, userID)
+	}
+	if invite.Role == inviteRoleCoHost && !containsString(meeting.CoHosts, userID) {
+		meeting.CoHosts = append(meeting.CoHosts, userID)
+	}
+	return nil
+}
+
+// meetingURL is the frontend link to a meeting. APP_URL points at the
+// frontend; without it the link is relative.
+func meetingURL(meetingID string) string {
+	return strings.TrimSuffix(os.Getenv("APP_URL"), "/") + "/meeting/" + url.PathEscape(meetingID)
+}
+
+// inviteURL builds the link a host shares
+func inviteURL(meetingID, token string) string {
+	return meetingURL(meetingID) + "?invite=" + url.QueryEscape(token)
+}
+
+// accessErrorStatus maps passcode and invite errors to HTTP status codes
+func accessErrorStatus(err error) int {
+	switch err {
+	case errPasscodeRequired:
+		return 401
+	case errInvalidPasscode, errInviteInvalid, errInviteRevoked, errInviteUsedUp:
+		return 403
+	default:
+		return 500
+	}
+}
+
+// setPasscodeHandler sets or, with an empty passcode, clears a meeting's passcode
+func setPasscodeHandler(c *gin.Context) {
+	var passcodeData struct {
+		Passcode string `json:"passcode"`
+	}
+
+	if err := c.ShouldBindJSON(&passcodeData); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+
+	hash := ""
+	if passcodeData.Passcode != "" {
+		var err error
+		hash, err = hashPasscode(passcodeData.Passcode)
+		if err == errPasscodeLength {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to set passcode"})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{"$set": bson.M{"passcode_hash": hash}},
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to set passcode"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":      "Passcode updated",
+		"has_passcode": hash != "",
+	})
+}
+
+// createInviteHandler mints a signed invite link for a meeting
+func createInviteHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	var inviteData struct {
+		ExpiresIn string `json:"expiresIn"` // Go duration, e.g. "48h"
+		MaxUses   int    `json:"maxUses"`
+		Role      string `json:"role"`
+	}
+
+	if err := c.ShouldBindJSON(&inviteData); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	ttl := defaultInviteTTL
+	if inviteData.ExpiresIn != "" {
+		parsed, err := time.ParseDuration(inviteData.ExpiresIn)
+		if err != nil || parsed <= 0 {
+			c.JSON(400, gin.H{"error": "expiresIn must be a positive duration such as 48h"})
+			return
+		}
+		ttl = parsed
+	}
+	if inviteData.MaxUses < 0 {
+		c.JSON(400, gin.H{"error": "maxUses cannot be negative"})
+		return
+	}
+	switch inviteData.Role {
+	case "":
+		inviteData.Role = inviteRoleParticipant
+	case inviteRoleParticipant, inviteRoleCoHost:
+	default:
+		c.JSON(400, gin.H{"error": "role must be participant or cohost"})
+		return
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+	// Only the owner can hand out host powers, as with setCoHost
+	if inviteData.Role == inviteRoleCoHost && meeting.CreatedBy.Hex() != claims.UserID {
+		c.JSON(403, gin.H{"error": errNotOwner.Error()})
+		return
+	}
+
+	now := time.Now()
+	invite := Invite{
+		MeetingID:  meeting.MeetingID,
+		Role:       inviteData.Role,
+		CreatedBy:  claims.UserID,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+		MaxUses:    inviteData.MaxUses,
+		RedeemedBy: []string{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("invites").InsertOne(ctx, invite)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create invite"})
+		return
+	}
+	invite.ID = result.InsertedID.(primitive.ObjectID)
+
+	token, err := signInvite(&invite)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to sign invite"})
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"message": "Invite created successfully",
+		"invite":  invite,
+		"token":   token,
+		"url":     inviteURL(meeting.MeetingID, token),
+	})
+}
+
+func listInvitesHandler(c *gin.Context) {
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.Collection("invites").Find(ctx, bson.M{"meeting_id": meeting.MeetingID})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch invites"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	invites := []Invite{}
+	if err = cursor.All(ctx, &invites); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to decode invites"})
+		return
+	}
+
+	c.JSON(200, gin.H{"invites": invites})
+}
+
+// revokeInviteHandler stops an invite from letting anyone else in. People
+// who already used it keep their access.
+func revokeInviteHandler(c *gin.Context) {
+	inviteID, err := primitive.ObjectIDFromHex(c.Param("inviteId"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid invite ID"})
+		return
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("invites").UpdateOne(
+		ctx,
+		bson.M{"_id": inviteID, "meeting_id": meeting.MeetingID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke invite"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(404, gin.H{"error": "Invite not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Invite revoked"})
+}
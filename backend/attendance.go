@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AttendanceSession is one stretch of time a user spent in a meeting, from
+// the hub registering their connection to it going away
+type AttendanceSession struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	MeetingID string             `bson:"meeting_id" json:"meeting_id"`
+	UserID    string             `bson:"user_id" json:"user_id"`
+	UserName  string             `bson:"user_name" json:"user_name"`
+	NodeID    string             `bson:"node_id" json:"node_id"`
+	JoinedAt  time.Time          `bson:"joined_at" json:"joined_at"`
+	LeftAt    *time.Time         `bson:"left_at,omitempty" json:"left_at,omitempty"`
+}
+
+// AttendanceRecord sums up one user's sessions in a meeting
+type AttendanceRecord struct {
+	UserID       string     `json:"user_id"`
+	UserName     string     `json:"user_name"`
+	FirstJoin    time.Time  `json:"first_join"`
+	LastLeave    *time.Time `json:"last_leave,omitempty"` // unset while still connected
+	TotalSeconds int64      `json:"total_seconds"`
+	Sessions     int        `json:"sessions"`
+	Reconnects   int        `json:"reconnects"`
+}
+
+// sessionEvent opens or closes an attendance session
+type sessionEvent struct {
+	session AttendanceSession
+	leave   bool
+}
+
+func ensureAttendanceIndexes(ctx context.Context) error {
+	_, err := db.Collection("attendance").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "meeting_id", Value: 1}, {Key: "joined_at", Value: 1}},
+	})
+	return err
+}
+
+// logSessionLocked queues a join or leave for conn's current session
+// without blocking the hub. Caller must hold h.mutex.
+func (h *Hub) logSessionLocked(conn *Connection, leave bool) {
+	event := &sessionEvent{
+		session: AttendanceSession{
+			ID:        conn.sessionID,
+			MeetingID: conn.meetingID,
+			UserID:    conn.userID,
+			UserName:  conn.userName,
+			NodeID:    h.nodeID,
+			JoinedAt:  conn.joinedAt,
+		},
+		leave: leave,
+	}
+	select {
+	case h.sessions <- event:
+	default:
+		log.Printf("Attendance buffer full, dropping session event for user %s in meeting %s", conn.userID, conn.meetingID)
+	}
+}
+
+// sessionLoop writes attendance in the order the hub saw it, so a leave is
+// never stored before its join
+func (h *Hub) sessionLoop() {
+	for event := range h.sessions {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		var err error
+		if event.leave {
+			_, err = db.Collection("attendance").UpdateOne(
+				ctx,
+				bson.M{"_id": event.session.ID},
+				bson.M{"$set": bson.M{"left_at": time.Now()}},
+			)
+		} else {
+			_, err = db.Collection("attendance").InsertOne(ctx, event.session)
+		}
+		cancel()
+
+		if err != nil {
+			log.Printf("Failed to record attendance for user %s in meeting %s: %v", event.session.UserID, event.session.MeetingID, err)
+		}
+	}
+}
+
+// summarizeAttendance totals sessions per user. Sessions still open count
+// up to openUntil.
+func summarizeAttendance(sessions []AttendanceSession, openUntil time.Time) []AttendanceRecord {
+	byUser := make(map[string]*AttendanceRecord)
+	connected := make(map[string]bool)
+	var order []string
+
+	for _, session := range sessions {
+		record, exists := byUser[session.UserID]
+		if !exists {
+			record = &AttendanceRecord{
+				UserID:    session.UserID,
+				UserName:  session.UserName,
+				FirstJoin: session.JoinedAt,
+			}
+			byUser[session.UserID] = record
+			order = append(order, session.UserID)
+		}
+
+		end := openUntil
+		if session.LeftAt == nil {
+			connected[session.UserID] = true
+		} else {
+			end = *session.LeftAt
+			if record.LastLeave == nil || end.After(*record.LastLeave) {
+				left := end
+				record.LastLeave = &left
+			}
+		}
+		if end.After(session.JoinedAt) {
+			record.TotalSeconds += int64(end.Sub(session.JoinedAt).Seconds())
+		}
+		if session.JoinedAt.Before(record.FirstJoin) {
+			record.FirstJoin = session.JoinedAt
+		}
+		record.Sessions++
+		record.Reconnects = record.Sessions - 1
+	}
+
+	records := make([]AttendanceRecord, 0, len(order))
+	for _, userID := range order {
+		record := byUser[userID]
+		if connected[userID] {
+			record.LastLeave = nil
+		}
+		records = append(records, *record)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].FirstJoin.Before(records[j].FirstJoin) })
+	return records
+}
+
+// attendanceHandler reports who attended a meeting and for how long, as
+// JSON or, with ?format=csv, as a CSV download. ?since= and ?until= (RFC
+// 3339) pick out one sitting of a recurring meeting or personal room.
+func attendanceHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(400, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	joined := bson.M{}
+	for param, operator := range map[string]string{"since": "$gte", "until": "$lt"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": param + " must be an RFC 3339 timestamp"})
+			return
+		}
+		joined[operator] = parsed
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+	filter := bson.M{"meeting_id": meeting.MeetingID}
+	if len(joined) > 0 {
+		filter["joined_at"] = joined
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := db.Collection("attendance").Find(ctx, filter, options.Find().SetSort(bson.M{"joined_at": 1}))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch attendance"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []AttendanceSession
+	if err = cursor.All(ctx, &sessions); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to decode attendance"})
+		return
+	}
+
+	// Open sessions run until now while the meeting is live, otherwise
+	// until it ended (the node holding them may have gone down)
+	openUntil := time.Now()
+	if meeting.Status != meetingStatusLive && meeting.EndedAt != nil {
+		openUntil = *meeting.EndedAt
+	}
+	records := summarizeAttendance(sessions, openUntil)
+
+	if format == "json" {
+		c.JSON(200, gin.H{
+			"meeting_id": meeting.MeetingID,
+			"attendance": records,
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meeting.MeetingID+"-attendance.csv"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(200)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"user_id", "user_name", "first_join", "last_leave", "total_seconds", "sessions", "reconnects"})
+	for _, record := range records {
+		lastLeave := ""
+		if record.LastLeave != nil {
+			lastLeave = record.LastLeave.UTC().Format(time.RFC3339)
+		}
+		writer.Write([]string{
+			record.UserID,
+			csvSafe(record.UserName),
+			record.FirstJoin.UTC().Format(time.RFC3339),
+			lastLeave,
+			strconv.FormatInt(record.TotalSeconds, 10),
+			strconv.Itoa(record.Sessions),
+			strconv.Itoa(record.Reconnects),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Failed to write attendance CSV for meeting %s: %v", meeting.MeetingID, err)
+	}
+}
+
+// csvSafe stops spreadsheets from running a user supplied value as a formula
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
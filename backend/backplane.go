@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	heartbeatInterval   = 5 * time.Second
+	nodeExpiry          = 3 * heartbeatInterval // a node silent this long is presumed dead
+	defaultNATSSubject  = "delta-meet.hub"
+	leaveReasonNodeLost = "node-lost"
+)
+
+// Kinds of envelope exchanged between hubs
+const (
+	envelopeBroadcast  = "broadcast"
+	envelopeDirect     = "direct"
+	envelopeJoin       = "join"
+	envelopeLeave      = "leave"
+	envelopeHeartbeat  = "heartbeat"
+	envelopeKick       = "kick"
+	envelopeEnd        = "end"
+	envelopeHostChange = "host-change"
+
+	envelopeLobbyJoin     = "lobby-join"
+	envelopeLobbyLeave    = "lobby-leave"
+	envelopeLobbyDecision = "lobby-decision"
+)
+
+// Backplane carries hub traffic between backend nodes so that users
+// connected to different replicas can share a meeting
+type Backplane interface {
+	// Publish sends an envelope to every other node
+	Publish(env *BackplaneEnvelope) error
+	// Subscribe registers the handler for envelopes published by other nodes
+	Subscribe(handler func(*BackplaneEnvelope)) error
+	Close() error
+}
+
+// BackplaneEnvelope is one hub event as seen by other nodes
+type BackplaneEnvelope struct {
+	NodeID        string                   `json:"nodeId"`
+	Kind          string                   `json:"kind"`
+	MeetingID     string                   `json:"meetingId,omitempty"`
+	ExcludeUserID string                   `json:"excludeUserId,omitempty"`
+	TargetUserID  string                   `json:"targetUserId,omitempty"`
+	Message       json.RawMessage          `json:"message,omitempty"`
+	Participant   *Participant             `json:"participant,omitempty"`
+	Reason        string                   `json:"reason,omitempty"`
+	Roster        map[string][]Participant `json:"roster,omitempty"` // heartbeat only: meetingID -> local participants
+	Decision      *LobbyDecision           `json:"decision,omitempty"`
+	Host          bool                     `json:"host,omitempty"` // host-change only
+}
+
+// remoteParticipant is a user connected to another node
+type remoteParticipant struct {
+	nodeID      string
+	participant Participant
+}
+
+// publish queues an envelope for the backplane without blocking the hub
+func (h *Hub) publish(env *BackplaneEnvelope) {
+	env.NodeID = h.nodeID
+	select {
+	case h.outbound <- env:
+	default:
+		log.Printf("Backplane outbound buffer full, dropping %s envelope", env.Kind)
+	}
+}
+
+func (h *Hub) publishLoop() {
+	for env := range h.outbound {
+		if err := h.backplane.Publish(env); err != nil {
+			log.Printf("Backplane publish error: %v", err)
+		}
+	}
+}
+
+// heartbeatLoop announces this node's participants and expires nodes
+// that have stopped announcing theirs
+func (h *Hub) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		h.heartbeat(now)
+	}
+}
+
+// heartbeat is one tick of heartbeatLoop
+func (h *Hub) heartbeat(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	roster := make(map[string][]Participant, len(h.meetings))
+	for meetingID, meetingConns := range h.meetings {
+		for _, conn := range meetingConns {
+			roster[meetingID] = append(roster[meetingID], conn.participant())
+		}
+	}
+	// Queued under the lock so it cannot overtake a join or leave
+	h.publish(&BackplaneEnvelope{Kind: envelopeHeartbeat, Roster: roster})
+	h.expireNodesLocked(now)
+}
+
+func (h *Hub) handleRemote(env *BackplaneEnvelope) {
+	if env.NodeID == h.nodeID {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.nodesSeen[env.NodeID] = time.Now()
+
+	switch env.Kind {
+	case envelopeBroadcast:
+		h.fanOut(env.MeetingID, env.Message, env.ExcludeUserID)
+	case envelopeDirect:
+		if conn, exists := h.meetings[env.MeetingID][env.TargetUserID]; exists {
+			if !conn.trySend(env.Message) {
+				log.Printf("Send buffer full for user %s in meeting %s, closing connection", env.TargetUserID, env.MeetingID)
+				h.removeLocked(conn, leaveReasonBufferFull)
+			}
+		}
+	case envelopeJoin:
+		if env.Participant != nil {
+			h.addRemoteLocked(env.NodeID, env.MeetingID, *env.Participant)
+		}
+	case envelopeLeave:
+		if env.Participant != nil {
+			h.removeRemoteLocked(env.NodeID, env.MeetingID, env.Participant.UserID, env.Reason)
+		}
+	case envelopeHeartbeat:
+		h.reconcileLocked(env.NodeID, env.Roster)
+	case envelopeKick:
+		h.kickLocked(env.MeetingID, env.TargetUserID, env.Reason)
+	case envelopeEnd:
+		h.endLocked(env.MeetingID, env.Message)
+	case envelopeHostChange:
+		h.applyHostChangeLocked(env.MeetingID, env.TargetUserID, env.Host)
+	case envelopeLobbyJoin:
+		if env.Participant != nil {
+			h.addRemoteLobbyLocked(env.NodeID, env.MeetingID, *env.Participant)
+		}
+	case envelopeLobbyLeave:
+		if env.Participant != nil {
+			h.removeRemoteLobbyLocked(env.NodeID, env.MeetingID, env.Participant.UserID)
+		}
+	case envelopeLobbyDecision:
+		if env.Decision != nil {
+			h.applyLobbyDecisionLocked(env.Decision)
+		}
+	default:
+		log.Printf("Unknown backplane envelope kind: %s", env.Kind)
+	}
+}
+
+// addRemoteLocked records a user who joined on another node. Caller must hold h.mutex.
+func (h *Hub) addRemoteLocked(nodeID, meetingID string, participant Participant) {
+	// The user moved to another node, so drop our connection without announcing a leave
+	if conn, exists := h.meetings[meetingID][participant.UserID]; exists {
+		log.Printf("User %s moved to node %s, closing local connection in meeting %s", participant.UserID, nodeID, meetingID)
+		h.detachLocked(conn)
+	}
+
+	h.stopIdleTimerLocked(meetingID)
+	if h.remoteParticipants[meetingID] == nil {
+		h.remoteParticipants[meetingID] = make(map[string]remoteParticipant)
+	}
+	h.remoteParticipants[meetingID][participant.UserID] = remoteParticipant{nodeID: nodeID, participant: participant}
+
+	h.fanOut(meetingID, presenceMessage("participant-joined", meetingID, participant, participant), "")
+}
+
+// removeRemoteLocked forgets a user on another node, unless they have since
+// shown up somewhere else. Caller must hold h.mutex.
+func (h *Hub) removeRemoteLocked(nodeID, meetingID, userID, reason string) {
+	entry, exists := h.remoteParticipants[meetingID][userID]
+	if !exists || entry.nodeID != nodeID {
+		return
+	}
+
+	delete(h.remoteParticipants[meetingID], userID)
+	if len(h.remoteParticipants[meetingID]) == 0 {
+		delete(h.remoteParticipants, meetingID)
+		// The node that held the last participant may be gone, so end it from here
+		if len(h.meetings[meetingID]) == 0 {
+			h.scheduleIdleEndLocked(meetingID)
+		}
+	}
+
+	h.fanOut(meetingID, presenceMessage("participant-left", meetingID, entry.participant, map[string]string{"reason": reason}), "")
+}
+
+// reconcileLocked brings our view of a node in line with its heartbeat,
+// repairing any join or leave we missed. Caller must hold h.mutex.
+func (h *Hub) reconcileLocked(nodeID string, roster map[string][]Participant) {
+	reported := make(map[string]map[string]bool, len(roster))
+	for meetingID, participants := range roster {
+		reported[meetingID] = make(map[string]bool, len(participants))
+		for _, participant := range participants {
+			reported[meetingID][participant.UserID] = true
+			if _, local := h.meetings[meetingID][participant.UserID]; local {
+				continue
+			}
+			if _, known := h.remoteParticipants[meetingID][participant.UserID]; !known {
+				h.addRemoteLocked(nodeID, meetingID, participant)
+			}
+		}
+	}
+
+	for meetingID, entries := range h.remoteParticipants {
+		for userID, entry := range entries {
+			if entry.nodeID == nodeID && !reported[meetingID][userID] {
+				h.removeRemoteLocked(nodeID, meetingID, userID, leaveReasonDisconnected)
+			}
+		}
+	}
+}
+
+// expireNodesLocked drops every participant of nodes that missed their
+// heartbeats. Caller must hold h.mutex.
+func (h *Hub) expireNodesLocked(now time.Time) {
+	for nodeID, seen := range h.nodesSeen {
+		if now.Sub(seen) < nodeExpiry {
+			continue
+		}
+
+		log.Printf("Node %s missed its heartbeats, expiring its participants", nodeID)
+		delete(h.nodesSeen, nodeID)
+		for meetingID, entries := range h.remoteParticipants {
+			for userID, entry := range entries {
+				if entry.nodeID == nodeID {
+					h.removeRemoteLocked(nodeID, meetingID, userID, leaveReasonNodeLost)
+				}
+			}
+		}
+		for meetingID, entries := range h.remoteLobby {
+			for userID, entry := range entries {
+				if entry.nodeID == nodeID {
+					h.removeRemoteLobbyLocked(nodeID, meetingID, userID)
+				}
+			}
+		}
+	}
+}
+
+// memoryBus links the hubs of a single process. With one hub attached it
+// is the default single node backplane; with several it lets them share
+// meetings without any external broker.
+type memoryBus struct {
+	members []*memoryBackplane
+	mutex   sync.RWMutex
+}
+
+type memoryBackplane struct {
+	bus     *memoryBus
+	handler func(*BackplaneEnvelope)
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{}
+}
+
+func (b *memoryBus) connect() *memoryBackplane {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	member := &memoryBackplane{bus: b}
+	b.members = append(b.members, member)
+	return member
+}
+
+func (m *memoryBackplane) Publish(env *BackplaneEnvelope) error {
+	m.bus.mutex.RLock()
+	defer m.bus.mutex.RUnlock()
+
+	for _, member := range m.bus.members {
+		if member != m && member.handler != nil {
+			member.handler(env)
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackplane) Subscribe(handler func(*BackplaneEnvelope)) error {
+	m.bus.mutex.Lock()
+	defer m.bus.mutex.Unlock()
+	m.handler = handler
+	return nil
+}
+
+func (m *memoryBackplane) Close() error {
+	m.bus.mutex.Lock()
+	defer m.bus.mutex.Unlock()
+
+	for i, member := range m.bus.members {
+		if member == m {
+			m.bus.members = append(m.bus.members[:i], m.bus.members[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// natsBackplane shares hub traffic between nodes over a NATS subject
+type natsBackplane struct {
+	conn         *nats.Conn
+	subject      string
+	subscription *nats.Subscription
+}
+
+func newNATSBackplane(url, subject string) (*natsBackplane, error) {
+	conn, err := nats.Connect(url, nats.Name("delta-meet-hub"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &natsBackplane{conn: conn, subject: subject}, nil
+}
+
+func (n *natsBackplane) Publish(env *BackplaneEnvelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return n.conn.Publish(n.subject, data)
+}
+
+func (n *natsBackplane) Subscribe(handler func(*BackplaneEnvelope)) error {
+	subscription, err := n.conn.Subscribe(n.subject, func(msg *nats.Msg) {
+		var env BackplaneEnvelope
+		if err := json.Unmarshal(msg.Data, &env); err != nil {
+			log.Printf("Dropping malformed backplane envelope: %v", err)
+			return
+		}
+		handler(&env)
+	})
+	if err != nil {
+		return err
+	}
+	n.subscription = subscription
+	return nil
+}
+
+func (n *natsBackplane) Close() error {
+	if n.subscription != nil {
+		n.subscription.Unsubscribe()
+	}
+	return n.conn.Drain()
+}
+
+// newBackplaneFromEnv picks the backplane named by BACKPLANE, defaulting
+// to a process-local one
+func newBackplaneFromEnv() (Backplane, error) {
+	switch kind := os.Getenv("BACKPLANE"); kind {
+	case "", "memory":
+		return newMemoryBus().connect(), nil
+	case "nats":
+		url := os.Getenv("NATS_URL")
+		if url == "" {
+			url = nats.DefaultURL
+		}
+		subject := os.Getenv("NATS_SUBJECT")
+		if subject == "" {
+			subject = defaultNATSSubject
+		}
+		return newNATSBackplane(url, subject)
+	default:
+		return nil, fmt.Errorf("unknown BACKPLANE %q", kind)
+	}
+}
+
+// newNodeID identifies this process on the backplane
+func newNodeID() string {
+	if nodeID := os.Getenv("NODE_ID"); nodeID != "" {
+		return nodeID
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "node"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Sprintf("%s-%d", hostname, time.Now().UnixNano())
+	}
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
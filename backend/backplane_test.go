@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var testDatabaseOnce sync.Once
+
+// useUnreachableDatabase points db at a server that is not there, so the
+// attendance and participant writes a join starts fail fast and only log
+func useUnreachableDatabase(t *testing.T) {
+	t.Helper()
+
+	testDatabaseOnce.Do(func() {
+		client, err := mongo.Connect(context.Background(), options.Client().
+			ApplyURI("mongodb://127.0.0.1:1").
+			SetServerSelectionTimeout(100*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db = client.Database("backplane-test")
+	})
+}
+
+// startTestHub runs a hub on bus the way main does on a real backplane
+func startTestHub(t *testing.T, bus *memoryBus, nodeID string) *Hub {
+	t.Helper()
+
+	h, err := newHub(nodeID, bus.connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.run()
+	go h.publishLoop()
+	go h.sessionLoop()
+	return h
+}
+
+func joinTestHub(h *Hub, meetingID, userID string) *Connection {
+	conn := &Connection{
+		hub:       h,
+		userID:    userID,
+		userName:  userID,
+		meetingID: meetingID,
+		send:      make(chan []byte, 256),
+	}
+	h.register <- conn
+	return conn
+}
+
+// expectMessage waits for the next frame of the given type sent to conn,
+// skipping any others
+func expectMessage(t *testing.T, conn *Connection, messageType string) WebSocketMessage {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case data, ok := <-conn.send:
+			if !ok {
+				t.Fatalf("%s was closed while waiting for %s", conn.userID, messageType)
+			}
+			var msg WebSocketMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("%s got a malformed frame: %v", conn.userID, err)
+			}
+			if msg.Type == messageType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("%s got no %s message", conn.userID, messageType)
+		}
+	}
+}
+
+func hasParticipant(participants []Participant, userID string) bool {
+	for _, participant := range participants {
+		if participant.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBackplaneSharesMeetingAcrossNodes(t *testing.T) {
+	useUnreachableDatabase(t)
+
+	const meetingID = "abc-defg-hij"
+	bus := newMemoryBus()
+	nodeA := startTestHub(t, bus, "node-a")
+	nodeB := startTestHub(t, bus, "node-b")
+
+	alice := joinTestHub(nodeA, meetingID, "alice")
+	expectMessage(t, alice, "roster")
+	bob := joinTestHub(nodeB, meetingID, "bob")
+	expectMessage(t, bob, "roster")
+
+	// Presence: each node announces its user to the other
+	joined := expectMessage(t, alice, "participant-joined")
+	if joined.UserID != "bob" {
+		t.Fatalf("alice was told %q joined, want bob", joined.UserID)
+	}
+	if !hasParticipant(nodeA.participants(meetingID), "bob") {
+		t.Errorf("node-a does not list bob as a participant")
+	}
+	if !hasParticipant(nodeB.participants(meetingID), "alice") {
+		t.Errorf("node-b does not list alice as a participant")
+	}
+
+	// Chat is broadcast to users on the other node
+	nodeA.sendChatEvent(&ChatMessage{MeetingID: meetingID, UserID: "alice", Visibility: chatVisibilityEveryone}, WebSocketMessage{
+		Type:      "chat",
+		Data:      "hello from node-a",
+		UserID:    "alice",
+		MeetingID: meetingID,
+	})
+	if chat := expectMessage(t, bob, "chat"); chat.Data != "hello from node-a" || chat.UserID != "alice" {
+		t.Errorf("bob got chat %v from %q, want alice's message", chat.Data, chat.UserID)
+	}
+
+	// Signaling targeted at a user on the other node reaches only them
+	alice.handleSignaling(WebSocketMessage{
+		Type:         "signaling",
+		Data:         map[string]string{"type": "offer", "sdp": "v=0"},
+		UserID:       "alice",
+		MeetingID:    meetingID,
+		TargetUserID: "bob",
+	})
+	signal := expectMessage(t, bob, "signaling")
+	if signal.UserID != "alice" || signal.TargetUserID != "bob" {
+		t.Errorf("bob got signaling from %q to %q, want alice to bob", signal.UserID, signal.TargetUserID)
+	}
+
+	// A node that stops sending heartbeats takes its users with it
+	nodeA.heartbeat(time.Now().Add(nodeExpiry))
+
+	left := expectMessage(t, alice, "participant-left")
+	if left.UserID != "bob" {
+		t.Fatalf("alice was told %q left, want bob", left.UserID)
+	}
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	if err := decodeData(left.Data, &reason); err != nil || reason.Reason != leaveReasonNodeLost {
+		t.Errorf("bob left for %q, want %q", reason.Reason, leaveReasonNodeLost)
+	}
+	if hasParticipant(nodeA.participants(meetingID), "bob") {
+		t.Errorf("node-a still lists bob after node-b expired")
+	}
+
+	// Its next heartbeat brings them back
+	nodeB.heartbeat(time.Now())
+	if rejoined := expectMessage(t, alice, "participant-joined"); rejoined.UserID != "bob" {
+		t.Errorf("alice was told %q rejoined, want bob", rejoined.UserID)
+	}
+}
+
+func TestCoHostChangeReachesConnectionOnOtherNode(t *testing.T) {
+	useUnreachableDatabase(t)
+
+	const meetingID = "coh-ostc-hgx"
+	bus := newMemoryBus()
+	nodeA := startTestHub(t, bus, "node-a")
+	nodeB := startTestHub(t, bus, "node-b")
+
+	carol := joinTestHub(nodeA, meetingID, "carol")
+	expectMessage(t, carol, "roster")
+
+	// Promoted through a request handled by the other node
+	nodeB.hostChanges <- &HostChange{MeetingID: meetingID, UserID: "carol", Host: true}
+	expectMessage(t, carol, "lobby-update")
+
+	nodeB.hostChanges <- &HostChange{MeetingID: meetingID, UserID: "carol", Host: false}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		nodeA.mutex.RLock()
+		isHost := carol.isHost
+		nodeA.mutex.RUnlock()
+		if !isHost {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("carol kept host rights after being demoted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
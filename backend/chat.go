@@ -0,0 +1,840 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultChatPageSize = 50
+	maxChatPageSize     = 200
+)
+
+var errInvalidChatCursor = errors.New("cursor must be a message ID or an RFC 3339 timestamp")
+
+// chatPosition is a point in a meeting's chat, ordered by timestamp and
+// then by ID so that messages sharing a timestamp still page cleanly
+type chatPosition struct {
+	timestamp time.Time
+	id        *primitive.ObjectID // unset when the cursor was a bare timestamp
+}
+
+func ensureChatIndexes(ctx context.Context) error {
+	_, err := db.Collection("chat_messages").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "meeting_id", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "parent_id", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}},
+		// Chat search. A collection can only have one text index.
+		{Keys: bson.D{{Key: "message", Value: "text"}, {Key: "attachment.name", Value: "text"}}},
+	})
+	return err
+}
+
+// parseChatCursor resolves a message ID or timestamp into a position in
+// the meeting's chat
+func parseChatCursor(ctx context.Context, meetingID, cursor string) (*chatPosition, error) {
+	if id, err := primitive.ObjectIDFromHex(cursor); err == nil {
+		var message ChatMessage
+		err := db.Collection("chat_messages").FindOne(ctx, bson.M{"_id": id, "meeting_id": meetingID}).Decode(&message)
+		if err == mongo.ErrNoDocuments {
+			return nil, errInvalidChatCursor
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &chatPosition{timestamp: message.Timestamp, id: &id}, nil
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, cursor)
+	if err != nil {
+		return nil, errInvalidChatCursor
+	}
+	return &chatPosition{timestamp: timestamp}, nil
+}
+
+// filter matches messages strictly before (or after) the position
+func (p *chatPosition) filter(before bool) bson.M {
+	operator := "$gt"
+	if before {
+		operator = "$lt"
+	}
+	if p.id == nil {
+		return bson.M{"timestamp": bson.M{operator: p.timestamp}}
+	}
+	return bson.M{"$or": []bson.M{
+		{"timestamp": bson.M{operator: p.timestamp}},
+		{"timestamp": p.timestamp, "_id": bson.M{operator: *p.id}},
+	}}
+}
+
+// getChatMessagesHandler pages through a meeting's chat, oldest first
+// within a page:
+//
+//	(no cursor)   the latest messages
+//	?before=X     older messages, for scrolling back
+//	?after=X      newer messages
+//	?since=X      everything after X, for a client catching up after a reconnect
+//
+// Replies are left out of the main stream. ?thread=ID pages through the
+// replies to message ID instead. Private messages only show up for their
+// sender and recipient.
+//
+// X is a message ID or a timestamp. nextCursor continues in the same
+// direction and is empty when there is nothing more.
+func getChatMessagesHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	// Anyone who may join may read, as an invitee let in from the lobby
+	// loads the history before the join records them as a participant
+	meeting, ok := authorizeMeeting(c, c.Param("meetingId"), roleInvitee)
+	if !ok {
+		return
+	}
+	meetingID := meeting.MeetingID
+
+	limit := defaultChatPageSize
+	before, after := c.Query("before"), c.Query("after")
+	if since := c.Query("since"); since != "" {
+		after = since
+		limit = maxChatPageSize
+	}
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			c.JSON(400, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		limit = parsed
+	}
+	if limit > maxChatPageSize {
+		limit = maxChatPageSize
+	}
+	if before != "" && after != "" {
+		c.JSON(400, gin.H{"error": "Use only one of before, after and since"})
+		return
+	}
+
+	collection := db.Collection("chat_messages")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"meeting_id": meetingID, "parent_id": bson.M{"$exists": false}}
+	if thread := c.Query("thread"); thread != "" {
+		parentID, err := primitive.ObjectIDFromHex(thread)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "thread must be a message ID"})
+			return
+		}
+		filter["parent_id"] = parentID
+	}
+	conditions := []bson.M{filter, visibleChatFilter(claims.UserID)}
+	// Walk backwards from the newest message unless paging forwards
+	backwards := after == ""
+	if cursor := before + after; cursor != "" {
+		position, err := parseChatCursor(ctx, meetingID, cursor)
+		if err == errInvalidChatCursor {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch messages"})
+			return
+		}
+		conditions = append(conditions, position.filter(backwards))
+	}
+
+	order := 1
+	if backwards {
+		order = -1
+	}
+	// One extra tells us whether another page follows
+	cursor, err := collection.Find(
+		ctx,
+		bson.M{"$and": conditions},
+		options.Find().
+			SetSort(bson.D{{Key: "timestamp", Value: order}, {Key: "_id", Value: order}}).
+			SetLimit(int64(limit+1)),
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	messages := []ChatMessage{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to decode messages"})
+		return
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	for i := range messages {
+		messages[i].countReactions()
+	}
+	if backwards {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	nextCursor := ""
+	if hasMore {
+		if backwards {
+			nextCursor = messages[0].ID.Hex()
+		} else {
+			nextCursor = messages[len(messages)-1].ID.Hex()
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"messages":   messages,
+		"count":      len(messages),
+		"hasMore":    hasMore,
+		"nextCursor": nextCursor,
+	})
+}
+
+// chatEditWindow is how long authors may edit or delete their own messages.
+// Hosts can delete any message at any time.
+const chatEditWindow = 15 * time.Minute
+
+var (
+	errChatMessageNotFound = errors.New("message not found")
+	errChatMessageDeleted  = errors.New("message was deleted")
+	errNotMessageAuthor    = errors.New("only the author can do that")
+	errChatEditWindow      = errors.New("message is too old to change")
+	errEmptyChatMessage    = errors.New("message is required")
+)
+
+// ChatRevision is an earlier text of an edited message
+type ChatRevision struct {
+	Message   string    `bson:"message" json:"message"`
+	WrittenAt time.Time `bson:"written_at" json:"written_at"`
+}
+
+func loadChatMessage(ctx context.Context, meetingID string, messageID primitive.ObjectID) (*ChatMessage, error) {
+	var message ChatMessage
+	err := db.Collection("chat_messages").FindOne(ctx, bson.M{"_id": messageID, "meeting_id": meetingID}).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return nil, errChatMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// editChatMessage replaces the text of the author's own message, keeping
+// the old text as a revision, and tells the meeting
+func editChatMessage(h *Hub, meetingID, actorID string, messageID primitive.ObjectID, text string) (*ChatMessage, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errEmptyChatMessage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	message, err := loadChatMessage(ctx, meetingID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case message.Deleted:
+		return nil, errChatMessageDeleted
+	case message.UserID != actorID:
+		return nil, errNotMessageAuthor
+	case time.Since(message.Timestamp) > chatEditWindow:
+		return nil, errChatEditWindow
+	}
+
+	// The pipeline moves the current text into the revisions in the same
+	// write, so concurrent edits cannot lose one
+	now := time.Now()
+	var updated ChatMessage
+	err = db.Collection("chat_messages").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": messageID, "deleted": bson.M{"$ne": true}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"revisions": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$revisions", bson.A{}}},
+				bson.A{bson.M{
+					"message":    "$message",
+					"written_at": bson.M{"$ifNull": bson.A{"$edited_at", "$timestamp"}},
+				}},
+			}},
+			// $literal so text starting with $ is not read as a field path
+			"message":   bson.M{"$literal": text},
+			"edited_at": now,
+		}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, errChatMessageDeleted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h.sendChatEvent(&updated, WebSocketMessage{
+		Type:      "chat-edited",
+		Data:      updated,
+		UserID:    actorID,
+		MeetingID: meetingID,
+		Timestamp: now.Format(time.RFC3339),
+		ID:        messageID.Hex(),
+	})
+	return &updated, nil
+}
+
+// deleteChatMessage clears a message down to a tombstone, along with its
+// revisions, reactions and any attached file, and tells the meeting. Authors can delete their own messages
+// within chatEditWindow and hosts any message.
+func deleteChatMessage(h *Hub, meeting *Meeting, actorID string, messageID primitive.ObjectID) (*ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	message, err := loadChatMessage(ctx, meeting.MeetingID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if !message.visibleTo(actorID) {
+		return nil, errChatMessageNotFound
+	}
+	if message.Deleted {
+		return nil, errChatMessageDeleted
+	}
+	if !isMeetingHost(meeting, actorID) {
+		if message.UserID != actorID {
+			return nil, errNotMessageAuthor
+		}
+		if time.Since(message.Timestamp) > chatEditWindow {
+			return nil, errChatEditWindow
+		}
+	}
+
+	now := time.Now()
+	var updated ChatMessage
+	err = db.Collection("chat_messages").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": messageID, "deleted": bson.M{"$ne": true}},
+		bson.M{
+			"$set":   bson.M{"message": "", "deleted": true, "deleted_by": actorID, "deleted_at": now},
+			"$unset": bson.M{"revisions": "", "reactions": "", "attachment": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, errChatMessageDeleted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Attachment != nil {
+		go deleteAttachment(message.Attachment.FileID)
+	}
+	// The tombstone stays in the thread but no longer counts as a reply
+	if message.ParentID != nil {
+		_, err := db.Collection("chat_messages").UpdateOne(ctx, bson.M{"_id": *message.ParentID}, bson.M{"$inc": bson.M{"reply_count": -1}})
+		if err != nil {
+			log.Printf("Failed to update reply count of message %s: %v", message.ParentID.Hex(), err)
+		}
+	}
+	if actorID != message.UserID {
+		log.Printf("Host %s deleted message %s by user %s in meeting %s", actorID, messageID.Hex(), message.UserID, meeting.MeetingID)
+	}
+
+	h.sendChatEvent(&updated, WebSocketMessage{
+		Type:      "chat-deleted",
+		Data:      updated,
+		UserID:    actorID,
+		MeetingID: meeting.MeetingID,
+		Timestamp: now.Format(time.RFC3339),
+		ID:        messageID.Hex(),
+	})
+	return &updated, nil
+}
+
+// handleChatCommand serves chat-edit and chat-delete over the socket
+func (c *Connection) handleChatCommand(msg WebSocketMessage) {
+	var data struct {
+		MessageID string `json:"messageId"`
+		Message   string `json:"message"`
+	}
+	if err := decodeData(msg.Data, &data); err != nil {
+		c.sendError("Invalid " + msg.Type + " message")
+		return
+	}
+	messageID, err := primitive.ObjectIDFromHex(data.MessageID)
+	if err != nil {
+		c.sendError("Invalid message ID")
+		return
+	}
+
+	switch msg.Type {
+	case "chat-edit":
+		_, err = editChatMessage(c.hub, c.meetingID, c.userID, messageID, data.Message)
+	case "chat-delete":
+		var meeting *Meeting
+		if meeting, err = loadMeeting(c.meetingID); err == nil {
+			_, err = deleteChatMessage(c.hub, meeting, c.userID, messageID)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed %s of message %s by user %s: %v", msg.Type, data.MessageID, c.userID, err)
+		c.sendError(chatErrorMessage(err))
+	}
+}
+
+// chatErrorMessage is what a client is told when a chat change fails
+func chatErrorMessage(err error) string {
+	switch err {
+	case errChatMessageNotFound, errChatMessageDeleted, errNotMessageAuthor, errChatEditWindow, errEmptyChatMessage,
+		errInvalidReaction, errTooManyReactions, errPrivateChatDisabled, errPrivateReply, errInvalidRecipient:
+		return err.Error()
+	}
+	return "Failed to update message"
+}
+
+func chatErrorStatus(err error) int {
+	switch err {
+	case errChatMessageNotFound:
+		return 404
+	case errNotMessageAuthor, errChatEditWindow:
+		return 403
+	case errChatMessageDeleted:
+		return 409
+	case errPrivateChatDisabled:
+		return 403
+	case errEmptyChatMessage:
+		return 400
+	}
+	return 500
+}
+
+// chatMessageHandler serves PATCH and DELETE
+// /chat/:meetingId/messages/:messageId
+func chatMessageHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	messageID, err := primitive.ObjectIDFromHex(c.Param("messageId"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var editData struct {
+		Message string `json:"message"`
+	}
+	if c.Request.Method == "PATCH" {
+		if err := c.ShouldBindJSON(&editData); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("meetingId"), roleParticipant)
+	if !ok {
+		return
+	}
+
+	var message *ChatMessage
+	if c.Request.Method == "PATCH" {
+		message, err = editChatMessage(hub, meeting.MeetingID, claims.UserID, messageID, editData.Message)
+	} else {
+		message, err = deleteChatMessage(hub, meeting, claims.UserID, messageID)
+	}
+	if err != nil {
+		c.JSON(chatErrorStatus(err), gin.H{"error": chatErrorMessage(err)})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": message})
+}
+
+// maxReactionKinds caps how many different emoji one message can collect
+const maxReactionKinds = 20
+
+var (
+	errInvalidReaction  = errors.New("reaction must be a single emoji")
+	errTooManyReactions = errors.New("message has too many different reactions")
+)
+
+// countReactions fills in ReactionCounts from Reactions
+func (m *ChatMessage) countReactions() {
+	m.ReactionCounts = nil
+	for emoji, users := range m.Reactions {
+		if len(users) == 0 {
+			continue
+		}
+		if m.ReactionCounts == nil {
+			m.ReactionCounts = make(map[string]int)
+		}
+		m.ReactionCounts[emoji] = len(users)
+	}
+}
+
+// maxReactionLength bounds the bytes in a reaction. The longest emoji, ZWJ
+// sequences with skin tones, are around 35.
+const maxReactionLength = 64
+
+// validReaction accepts a single emoji. That also keeps out the characters
+// MongoDB treats specially in field names.
+func validReaction(emoji string) bool {
+	return len(emoji) <= maxReactionLength && utf8.ValidString(emoji) && singleEmoji(emoji)
+}
+
+// reactToChatMessage adds or removes the user's reaction and tells the
+// meeting the message's new reactions
+func reactToChatMessage(h *Hub, meetingID, actorID string, messageID primitive.ObjectID, emoji string, remove bool) (*ChatMessage, error) {
+	if !validReaction(emoji) {
+		return nil, errInvalidReaction
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	message, err := loadChatMessage(ctx, meetingID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if !message.visibleTo(actorID) {
+		return nil, errChatMessageNotFound
+	}
+	if message.Deleted {
+		return nil, errChatMessageDeleted
+	}
+	if _, exists := message.Reactions[emoji]; !exists && !remove && len(message.Reactions) >= maxReactionKinds {
+		return nil, errTooManyReactions
+	}
+
+	field := "reactions." + emoji
+	update := bson.M{"$addToSet": bson.M{field: actorID}}
+	if remove {
+		update = bson.M{"$pull": bson.M{field: actorID}}
+	}
+
+	collection := db.Collection("chat_messages")
+	var updated ChatMessage
+	err = collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": messageID, "deleted": bson.M{"$ne": true}},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, errChatMessageDeleted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop an emoji nobody is reacting with any more
+	if remove && len(updated.Reactions[emoji]) == 0 {
+		_, err := collection.UpdateOne(
+			ctx,
+			bson.M{"_id": messageID, field: bson.M{"$size": 0}},
+			bson.M{"$unset": bson.M{field: ""}},
+		)
+		if err != nil {
+			log.Printf("Failed to clear reaction %s on message %s: %v", emoji, messageID.Hex(), err)
+		}
+		delete(updated.Reactions, emoji)
+	}
+	updated.countReactions()
+
+	h.sendChatEvent(&updated, WebSocketMessage{
+		Type: "chat-reaction",
+		Data: map[string]interface{}{
+			"messageId":      messageID.Hex(),
+			"emoji":          emoji,
+			"removed":        remove,
+			"reactions":      updated.Reactions,
+			"reactionCounts": updated.ReactionCounts,
+		},
+		UserID:    actorID,
+		MeetingID: meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+		ID:        messageID.Hex(),
+	})
+	return &updated, nil
+}
+
+// replyToChatMessage posts a reply in the thread under parentID. Threads
+// are one level deep, so replying to a reply joins the same thread.
+func replyToChatMessage(conn *Connection, parentID primitive.ObjectID, text string) (*ChatMessage, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errEmptyChatMessage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	parent, err := loadChatMessage(ctx, conn.meetingID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	if !parent.visibleTo(conn.userID) {
+		return nil, errChatMessageNotFound
+	}
+	if parent.Visibility == chatVisibilityPrivate {
+		return nil, errPrivateReply
+	}
+	if parent.ParentID != nil {
+		parentID = *parent.ParentID
+	}
+
+	collection := db.Collection("chat_messages")
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": parentID, "deleted": bson.M{"$ne": true}},
+		bson.M{"$inc": bson.M{"reply_count": 1}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, errChatMessageDeleted
+	}
+
+	reply := ChatMessage{
+		MeetingID:  conn.meetingID,
+		UserID:     conn.userID,
+		UserName:   conn.userName,
+		UserEmail:  conn.userEmail,
+		Message:    text,
+		Timestamp:  time.Now(),
+		Visibility: chatVisibilityEveryone,
+		ParentID:   &parentID,
+	}
+	inserted, err := collection.InsertOne(ctx, reply)
+	if err != nil {
+		// Put the count back so it still matches the thread
+		collection.UpdateOne(ctx, bson.M{"_id": parentID}, bson.M{"$inc": bson.M{"reply_count": -1}})
+		return nil, err
+	}
+	reply.ID = inserted.InsertedID.(primitive.ObjectID)
+
+	conn.hub.sendChatEvent(&reply, WebSocketMessage{
+		Type:      "chat-reply",
+		Data:      reply,
+		UserID:    conn.userID,
+		UserName:  conn.userName,
+		UserEmail: conn.userEmail,
+		MeetingID: conn.meetingID,
+		Timestamp: reply.Timestamp.Format(time.RFC3339),
+		ID:        reply.ID.Hex(),
+	})
+	return &reply, nil
+}
+
+func (c *Connection) handleChatReaction(msg WebSocketMessage) {
+	var data struct {
+		MessageID string `json:"messageId"`
+		Emoji     string `json:"emoji"`
+		Remove    bool   `json:"remove"`
+	}
+	if err := decodeData(msg.Data, &data); err != nil {
+		c.sendError("Invalid chat-react message")
+		return
+	}
+	messageID, err := primitive.ObjectIDFromHex(data.MessageID)
+	if err != nil {
+		c.sendError("Invalid message ID")
+		return
+	}
+
+	if _, err := reactToChatMessage(c.hub, c.meetingID, c.userID, messageID, data.Emoji, data.Remove); err != nil {
+		log.Printf("Failed reaction to message %s by user %s: %v", data.MessageID, c.userID, err)
+		c.sendError(chatErrorMessage(err))
+	}
+}
+
+func (c *Connection) handleChatReply(msg WebSocketMessage) {
+	var data struct {
+		ParentID string `json:"parentId"`
+		Message  string `json:"message"`
+	}
+	if err := decodeData(msg.Data, &data); err != nil {
+		c.sendError("Invalid chat-reply message")
+		return
+	}
+	parentID, err := primitive.ObjectIDFromHex(data.ParentID)
+	if err != nil {
+		c.sendError("Invalid message ID")
+		return
+	}
+
+	if _, err := replyToChatMessage(c, parentID, data.Message); err != nil {
+		log.Printf("Failed reply to message %s by user %s: %v", data.ParentID, c.userID, err)
+		c.sendError(chatErrorMessage(err))
+	}
+}
+
+// Who can see a chat message
+const (
+	chatVisibilityEveryone = "everyone"
+	chatVisibilityPrivate  = "private" // sender and recipient only
+)
+
+var (
+	errPrivateChatDisabled = errors.New("private chat is turned off in this meeting")
+	errPrivateReply        = errors.New("private messages cannot have replies")
+	errInvalidRecipient    = errors.New("recipient is not connected to this meeting")
+)
+
+// visibleTo reports whether userID may see the message
+func (m *ChatMessage) visibleTo(userID string) bool {
+	return m.Visibility != chatVisibilityPrivate || m.UserID == userID || m.RecipientID == userID
+}
+
+// visibleChatFilter matches the messages userID may see. Messages from
+// before visibility was stored have none and are public.
+func visibleChatFilter(userID string) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"visibility": bson.M{"$ne": chatVisibilityPrivate}},
+		{"user_id": userID},
+		{"recipient_id": userID},
+	}}
+}
+
+// sendChatEvent tells everyone who can see message about a change to it
+func (h *Hub) sendChatEvent(message *ChatMessage, event WebSocketMessage) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", event.Type, err)
+		return
+	}
+
+	if message.Visibility != chatVisibilityPrivate {
+		h.broadcast <- &BroadcastMessage{
+			MeetingID:   message.MeetingID,
+			Message:     data,
+			MessageType: event.Type,
+		}
+		return
+	}
+	for _, userID := range []string{message.UserID, message.RecipientID} {
+		h.direct <- &DirectMessage{
+			MeetingID:    message.MeetingID,
+			TargetUserID: userID,
+			Message:      data,
+			MessageType:  event.Type,
+		}
+	}
+}
+
+// connected reports whether userID is in the meeting on any node
+func (h *Hub) connected(meetingID, userID string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if _, exists := h.meetings[meetingID][userID]; exists {
+		return true
+	}
+	_, exists := h.remoteParticipants[meetingID][userID]
+	return exists
+}
+
+// sendPrivateChat stores a message only the sender and recipient can see and
+// delivers it to the recipient. Hosts can message privately even when
+// private chat is off.
+func (c *Connection) sendPrivateChat(recipientID, text string) error {
+	meeting, err := loadMeeting(c.meetingID)
+	if err != nil {
+		return err
+	}
+	if meeting.PrivateChatDisabled && !isMeetingHost(meeting, c.userID) {
+		return errPrivateChatDisabled
+	}
+	if recipientID == c.userID || !c.hub.connected(c.meetingID, recipientID) {
+		return errInvalidRecipient
+	}
+
+	message := ChatMessage{
+		MeetingID:   c.meetingID,
+		UserID:      c.userID,
+		UserName:    c.userName,
+		UserEmail:   c.userEmail,
+		Message:     text,
+		Timestamp:   time.Now(),
+		Visibility:  chatVisibilityPrivate,
+		RecipientID: recipientID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("chat_messages").InsertOne(ctx, message)
+	if err != nil {
+		return err
+	}
+	message.ID = result.InsertedID.(primitive.ObjectID)
+
+	data, err := json.Marshal(WebSocketMessage{
+		Type:        "chat",
+		Data:        message.Message,
+		UserID:      c.userID,
+		UserName:    c.userName,
+		UserEmail:   c.userEmail,
+		MeetingID:   c.meetingID,
+		Timestamp:   message.Timestamp.Format(time.RFC3339),
+		ID:          message.ID.Hex(),
+		RecipientID: recipientID,
+	})
+	if err != nil {
+		return err
+	}
+	c.hub.direct <- &DirectMessage{
+		MeetingID:    c.meetingID,
+		TargetUserID: recipientID,
+		Message:      data,
+		MessageType:  "chat",
+		Sender:       c,
+	}
+	return nil
+}
+
+// setPrivateChat lets participants message each other privately, or stops them
+func setPrivateChat(meeting *Meeting, actorID string, enabled bool) error {
+	if !isMeetingHost(meeting, actorID) {
+		return errNotHost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{"$set": bson.M{"private_chat_disabled": !enabled}},
+	)
+	if err != nil {
+		return err
+	}
+	meeting.PrivateChatDisabled = !enabled
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:      "private-chat-updated",
+		Data:      map[string]bool{"enabled": enabled},
+		UserID:    actorID,
+		MeetingID: meeting.MeetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportTimeout bounds a whole export, however long the meeting's chat
+const exportTimeout = 5 * time.Minute
+
+// exportFlushEvery is how many messages are written between flushes
+const exportFlushEvery = 100
+
+var exportContentTypes = map[string]string{
+	"json": "application/json; charset=utf-8",
+	"csv":  "text/csv; charset=utf-8",
+	"txt":  "text/plain; charset=utf-8",
+	"html": "text/html; charset=utf-8",
+}
+
+// exportedAttachment is a ChatAttachment with a link to download it
+type exportedAttachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// exportedMessage is a ChatMessage as it appears in an export, with times
+// in the caller's time zone
+type exportedMessage struct {
+	ID          string              `json:"id"`
+	UserID      string              `json:"user_id"`
+	Author      string              `json:"author"`
+	Message     string              `json:"message"`
+	Timestamp   string              `json:"timestamp"`
+	EditedAt    string              `json:"edited_at,omitempty"`
+	Deleted     bool                `json:"deleted,omitempty"`
+	ParentID    string              `json:"parent_id,omitempty"`
+	Private     bool                `json:"private,omitempty"`
+	RecipientID string              `json:"recipient_id,omitempty"`
+	Attachment  *exportedAttachment `json:"attachment,omitempty"`
+}
+
+func newExportedMessage(message *ChatMessage, loc *time.Location) *exportedMessage {
+	exported := &exportedMessage{
+		ID:          message.ID.Hex(),
+		UserID:      message.UserID,
+		Author:      message.UserName,
+		Message:     message.Message,
+		Timestamp:   message.Timestamp.In(loc).Format(time.RFC3339),
+		Deleted:     message.Deleted,
+		Private:     message.Visibility == chatVisibilityPrivate,
+		RecipientID: message.RecipientID,
+	}
+	if message.Deleted {
+		exported.Message = "message removed"
+	}
+	if message.EditedAt != nil {
+		exported.EditedAt = message.EditedAt.In(loc).Format(time.RFC3339)
+	}
+	if message.ParentID != nil {
+		exported.ParentID = message.ParentID.Hex()
+	}
+	if attachment := message.Attachment; attachment != nil {
+		exported.Attachment = &exportedAttachment{
+			Name:        attachment.Name,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+			URL:         fileURL(attachment.FileID.Hex()),
+		}
+	}
+	return exported
+}
+
+// transcriptWriter writes one export format. begin and end wrap the
+// messages, which arrive oldest first.
+type transcriptWriter interface {
+	begin() error
+	message(m *exportedMessage) error
+	end() error
+}
+
+type jsonTranscript struct {
+	w         io.Writer
+	meetingID string
+	title     string
+	timeZone  string
+	count     int
+}
+
+func (t *jsonTranscript) begin() error {
+	header, err := json.Marshal(map[string]string{
+		"meeting_id": t.meetingID,
+		"title":      t.title,
+		"time_zone":  t.timeZone,
+	})
+	if err != nil {
+		return err
+	}
+	// Reopen the header object to add the messages array
+	_, err = fmt.Fprintf(t.w, "%s,\"messages\":[", header[:len(header)-1])
+	return err
+}
+
+func (t *jsonTranscript) message(m *exportedMessage) error {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if t.count > 0 {
+		if _, err := io.WriteString(t.w, ","); err != nil {
+			return err
+		}
+	}
+	t.count++
+	_, err = t.w.Write(encoded)
+	return err
+}
+
+func (t *jsonTranscript) end() error {
+	_, err := io.WriteString(t.w, "]}\n")
+	return err
+}
+
+type csvTranscript struct {
+	w *csv.Writer
+}
+
+func (t *csvTranscript) begin() error {
+	return t.w.Write([]string{"id", "timestamp", "author", "user_id", "message", "parent_id", "private", "edited_at", "deleted", "attachment_name", "attachment_url"})
+}
+
+func (t *csvTranscript) message(m *exportedMessage) error {
+	attachmentName, attachmentURL := "", ""
+	if m.Attachment != nil {
+		attachmentName, attachmentURL = m.Attachment.Name, m.Attachment.URL
+	}
+	return t.w.Write([]string{
+		m.ID,
+		m.Timestamp,
+		csvSafe(m.Author),
+		m.UserID,
+		csvSafe(m.Message),
+		m.ParentID,
+		fmt.Sprint(m.Private),
+		m.EditedAt,
+		fmt.Sprint(m.Deleted),
+		csvSafe(attachmentName),
+		attachmentURL,
+	})
+}
+
+func (t *csvTranscript) end() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+type textTranscript struct {
+	w     io.Writer
+	title string
+	loc   *time.Location
+}
+
+func (t *textTranscript) begin() error {
+	_, err := fmt.Fprintf(t.w, "%s\nTimes in %s\n\n", t.title, t.loc)
+	return err
+}
+
+func (t *textTranscript) message(m *exportedMessage) error {
+	prefix := ""
+	if m.ParentID != "" {
+		prefix = "    ↳ "
+	}
+	line := fmt.Sprintf("%s[%s] %s: %s", prefix, m.Timestamp, m.Author, m.Message)
+	if m.Private {
+		line += " (private)"
+	}
+	if m.EditedAt != "" && !m.Deleted {
+		line += " (edited)"
+	}
+	if m.Attachment != nil {
+		line += fmt.Sprintf(" [file: %s %s]", m.Attachment.Name, m.Attachment.URL)
+	}
+	_, err := fmt.Fprintln(t.w, line)
+	return err
+}
+
+func (t *textTranscript) end() error {
+	return nil
+}
+
+type htmlTranscript struct {
+	w     io.Writer
+	title string
+	loc   *time.Location
+}
+
+func (t *htmlTranscript) begin() error {
+	title := html.EscapeString(t.title)
+	_, err := fmt.Fprintf(t.w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; }
+.message { margin: 0.5rem 0; }
+.reply { margin-left: 2rem; }
+.meta { color: #666; font-size: 0.85em; }
+.removed { color: #999; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<p class="meta">Times in %s</p>
+`, title, title, html.EscapeString(t.loc.String()))
+	return err
+}
+
+func (t *htmlTranscript) message(m *exportedMessage) error {
+	class := "message"
+	if m.ParentID != "" {
+		class += " reply"
+	}
+	text := html.EscapeString(m.Message)
+	if m.Deleted {
+		text = `<span class="removed">` + text + `</span>`
+	}
+
+	notes := ""
+	if m.Private {
+		notes += " · private"
+	}
+	if m.EditedAt != "" && !m.Deleted {
+		notes += " · edited"
+	}
+	attachment := ""
+	if m.Attachment != nil {
+		attachment = fmt.Sprintf(`<br><a href="%s">%s</a>`, html.EscapeString(m.Attachment.URL), html.EscapeString(m.Attachment.Name))
+	}
+
+	_, err := fmt.Fprintf(t.w, "<div class=\"%s\" id=\"m-%s\"><span class=\"meta\">%s%s</span><br><strong>%s</strong>: %s%s</div>\n",
+		class, m.ID, html.EscapeString(m.Timestamp), notes, html.EscapeString(m.Author), text, attachment)
+	return err
+}
+
+func (t *htmlTranscript) end() error {
+	_, err := io.WriteString(t.w, "</body>\n</html>\n")
+	return err
+}
+
+// exportChatHandler serves GET /chat/:meetingId/export, streaming every chat
+// message the caller can see as ?format=json, csv, txt or html. Times are
+// in the ?tz= time zone (an IANA name), UTC by default.
+func exportChatHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	format := c.DefaultQuery("format", "json")
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		c.JSON(400, gin.H{"error": "format must be json, csv, txt or html"})
+		return
+	}
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "tz must be an IANA time zone"})
+		return
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("meetingId"), roleParticipant)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), exportTimeout)
+	defer cancel()
+
+	cursor, err := db.Collection("chat_messages").Find(
+		ctx,
+		bson.M{"$and": []bson.M{{"meeting_id": meeting.MeetingID}, visibleChatFilter(claims.UserID)}},
+		options.Find().
+			SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+			SetBatchSize(500),
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	title := meeting.Title
+	if title == "" {
+		title = meeting.MeetingID
+	}
+	title += " chat"
+
+	var transcript transcriptWriter
+	switch format {
+	case "json":
+		transcript = &jsonTranscript{w: c.Writer, meetingID: meeting.MeetingID, title: meeting.Title, timeZone: loc.String()}
+	case "csv":
+		transcript = &csvTranscript{w: csv.NewWriter(c.Writer)}
+	case "txt":
+		transcript = &textTranscript{w: c.Writer, title: title, loc: loc}
+	case "html":
+		transcript = &htmlTranscript{w: c.Writer, title: title, loc: loc}
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meeting.MeetingID+"-chat."+format))
+	c.Header("Content-Type", contentType)
+	c.Status(200)
+
+	// Headers are sent, so failures from here on can only be logged
+	if err := transcript.begin(); err != nil {
+		log.Printf("Failed to export chat for meeting %s: %v", meeting.MeetingID, err)
+		return
+	}
+	written := 0
+	for cursor.Next(ctx) {
+		var message ChatMessage
+		if err := cursor.Decode(&message); err != nil {
+			log.Printf("Failed to decode chat message in export of meeting %s: %v", meeting.MeetingID, err)
+			return
+		}
+		if err := transcript.message(newExportedMessage(&message, loc)); err != nil {
+			log.Printf("Failed to export chat for meeting %s: %v", meeting.MeetingID, err)
+			return
+		}
+		if written++; written%exportFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		// Leave the output unterminated so it cannot pass for a whole export
+		log.Printf("Chat export of meeting %s stopped early: %v", meeting.MeetingID, err)
+		return
+	}
+	if err := transcript.end(); err != nil {
+		log.Printf("Failed to export chat for meeting %s: %v", meeting.MeetingID, err)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxAttachmentSize = 25 << 20 // 25MB
+	maxFileNameLength = 255
+	attachmentBucket  = "attachments"
+)
+
+// Content types browsers may show inline. Anything else is downloaded so an
+// uploaded page or script never runs on our origin.
+var inlineContentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+var errAttachmentTooLarge = errors.New("file is larger than 25MB")
+
+// ChatAttachment describes a file shared in chat. The content lives in the
+// attachments GridFS bucket under FileID.
+type ChatAttachment struct {
+	FileID      primitive.ObjectID `bson:"file_id" json:"file_id"`
+	Name        string             `bson:"name" json:"name"`
+	ContentType string             `bson:"content_type" json:"content_type"`
+	Size        int64              `bson:"size" json:"size"`
+}
+
+// attachmentMetadata is stored with each file in GridFS
+type attachmentMetadata struct {
+	MeetingID   string `bson:"meeting_id"`
+	UserID      string `bson:"user_id"`
+	ContentType string `bson:"content_type"`
+}
+
+// UploadProgress reports how much of an attachment has been received
+type UploadProgress struct {
+	Status   string `json:"status"` // uploading, complete or failed
+	Name     string `json:"name"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total,omitempty"` // unknown without a Content-Length
+}
+
+// fileURL is the download link for an attachment. API_URL points at this
+// server; without it the link is relative.
+func fileURL(fileID string) string {
+	return strings.TrimSuffix(os.Getenv("API_URL"), "/") + "/api/files/" + url.PathEscape(fileID)
+}
+
+func attachments() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(db, options.GridFSBucket().SetName(attachmentBucket))
+}
+
+// progressReader counts bytes read through it and reports every tenth of
+// the expected total
+type progressReader struct {
+	reader   io.Reader
+	received int64
+	total    int64
+	reported int64
+	report   func(received int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.received += int64(n)
+	if r.total > 0 && r.received-r.reported >= r.total/10 {
+		r.reported = r.received
+		r.report(r.received)
+	}
+	return n, err
+}
+
+// cleanFileName keeps the base name of an uploaded file, without control
+// characters, at a sensible length
+func cleanFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if len(name) > maxFileNameLength {
+		extension := filepath.Ext(name)
+		if len(extension) > 16 {
+			extension = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFileNameLength-len(extension)], "") + extension
+	}
+	return name
+}
+
+// sendUploadProgress tells the uploader, on their meeting connection, how
+// the upload of messageID is going
+func sendUploadProgress(meetingID string, claims *Claims, messageID primitive.ObjectID, progress UploadProgress) {
+	data, err := json.Marshal(WebSocketMessage{
+		Type:      "chat",
+		UserID:    claims.UserID,
+		UserName:  claims.Name,
+		UserEmail: claims.Email,
+		MeetingID: meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+		ID:        messageID.Hex(),
+		Upload:    &progress,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal upload progress: %v", err)
+		return
+	}
+	hub.direct <- &DirectMessage{
+		MeetingID:    meetingID,
+		TargetUserID: claims.UserID,
+		Message:      data,
+		MessageType:  "chat",
+	}
+}
+
+// storeAttachment streams one multipart file part into GridFS under fileID,
+// sniffing its type from the first bytes
+func storeAttachment(fileID primitive.ObjectID, name string, part io.Reader, metadata attachmentMetadata) (*ChatAttachment, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	metadata.ContentType = http.DetectContentType(head)
+
+	bucket, err := attachments()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := bucket.OpenUploadStreamWithID(fileID, name, options.GridFSUpload().SetMetadata(metadata))
+	if err != nil {
+		return nil, err
+	}
+
+	// Read one byte past the limit to tell a file of exactly the limit
+	// from a larger one
+	source := io.LimitReader(io.MultiReader(bytes.NewReader(head), part), maxAttachmentSize+1)
+	size, err := io.Copy(stream, source)
+	if err == nil && size > maxAttachmentSize {
+		err = errAttachmentTooLarge
+	}
+	if err != nil {
+		if abortErr := stream.Abort(); abortErr != nil {
+			log.Printf("Failed to abort upload of file %s: %v", fileID.Hex(), abortErr)
+		}
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	return &ChatAttachment{
+		FileID:      fileID,
+		Name:        name,
+		ContentType: metadata.ContentType,
+		Size:        size,
+	}, nil
+}
+
+func deleteAttachment(fileID primitive.ObjectID) {
+	bucket, err := attachments()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err = bucket.DeleteContext(ctx, fileID)
+	}
+	if err != nil && err != gridfs.ErrFileNotFound {
+		log.Printf("Failed to delete attachment %s: %v", fileID.Hex(), err)
+	}
+}
+
+// uploadFileHandler serves POST /meeting/:id/files, a multipart form with
+// the file in "file" and an optional caption in "message" before it. The
+// file is posted to the meeting chat. The uploader's connection hears how
+// the upload is going, and everyone gets the finished message.
+func uploadFileHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleParticipant)
+	if !ok {
+		return
+	}
+
+	// Leave room for the multipart framing and caption
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize+1<<20)
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Expected a multipart/form-data upload"})
+		return
+	}
+
+	messageID := primitive.NewObjectID()
+	fileID := primitive.NewObjectID()
+	caption := ""
+	var attachment *ChatAttachment
+
+	for attachment == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			c.JSON(400, gin.H{"error": "file is required"})
+			return
+		}
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			c.JSON(413, gin.H{"error": errAttachmentTooLarge.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid multipart upload"})
+			return
+		}
+
+		switch part.FormName() {
+		case "message":
+			value, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid multipart upload"})
+				return
+			}
+			caption = strings.TrimSpace(string(value))
+		case "file":
+			name := cleanFileName(part.FileName())
+			progress := &progressReader{
+				reader: part,
+				total:  c.Request.ContentLength,
+				report: func(received int64) {
+					sendUploadProgress(meeting.MeetingID, claims, messageID, UploadProgress{
+						Status:   "uploading",
+						Name:     name,
+						Received: received,
+						Total:    c.Request.ContentLength,
+					})
+				},
+			}
+
+			attachment, err = storeAttachment(fileID, name, progress, attachmentMetadata{
+				MeetingID: meeting.MeetingID,
+				UserID:    claims.UserID,
+			})
+			if err != nil {
+				sendUploadProgress(meeting.MeetingID, claims, messageID, UploadProgress{
+					Status:   "failed",
+					Name:     name,
+					Received: progress.received,
+				})
+				if err == errAttachmentTooLarge || errors.As(err, &maxBytesError) {
+					c.JSON(413, gin.H{"error": errAttachmentTooLarge.Error()})
+				} else {
+					log.Printf("Failed to store attachment for meeting %s: %v", meeting.MeetingID, err)
+					c.JSON(500, gin.H{"error": "Failed to store file"})
+				}
+				return
+			}
+		}
+		part.Close()
+	}
+
+	message := ChatMessage{
+		ID:         messageID,
+		MeetingID:  meeting.MeetingID,
+		UserID:     claims.UserID,
+		UserName:   claims.Name,
+		UserEmail:  claims.Email,
+		Message:    caption,
+		Timestamp:  time.Now(),
+		Visibility: chatVisibilityEveryone,
+		Attachment: attachment,
+	}
+	if message.Message == "" {
+		message.Message = attachment.Name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := db.Collection("chat_messages").InsertOne(ctx, message); err != nil {
+		deleteAttachment(fileID)
+		c.JSON(500, gin.H{"error": "Failed to save message"})
+		return
+	}
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:       "chat",
+		Data:       message.Message,
+		UserID:     claims.UserID,
+		UserName:   claims.Name,
+		UserEmail:  claims.Email,
+		MeetingID:  meeting.MeetingID,
+		Timestamp:  message.Timestamp.Format(time.RFC3339),
+		ID:         messageID.Hex(),
+		Attachment: attachment,
+		Upload: &UploadProgress{
+			Status:   "complete",
+			Name:     attachment.Name,
+			Received: attachment.Size,
+			Total:    attachment.Size,
+		},
+	})
+
+	c.JSON(201, gin.H{"message": message})
+}
+
+// downloadFileHandler streams an attachment back to a participant of the
+// meeting it was shared in
+func downloadFileHandler(c *gin.Context) {
+	fileID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	bucket, err := attachments()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to open file"})
+		return
+	}
+	stream, err := bucket.OpenDownloadStream(fileID)
+	if err == gridfs.ErrFileNotFound {
+		c.JSON(404, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to open file"})
+		return
+	}
+	defer stream.Close()
+
+	file := stream.GetFile()
+	var metadata attachmentMetadata
+	if err := bson.Unmarshal(file.Metadata, &metadata); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read file"})
+		return
+	}
+	if _, ok := authorizeMeeting(c, metadata.MeetingID, roleParticipant); !ok {
+		return
+	}
+
+	disposition := "attachment"
+	if inlineContentTypes[metadata.ContentType] {
+		disposition = "inline"
+	}
+	c.DataFromReader(200, file.Length, metadata.ContentType, stream, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=3600",
+	})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Meeting states. A meeting is scheduled until someone joins, live while
+// anyone is in it, and ended once a host ends it or it sits empty for
+// meetingIdleTimeout. Personal rooms and recurring series go back to
+// scheduled instead of ending for good.
+const (
+	meetingStatusScheduled = "scheduled"
+	meetingStatusLive      = "live"
+	meetingStatusEnded     = "ended"
+	meetingStatusCancelled = "cancelled"
+)
+
+// Reasons reported in meeting-ended events
+const (
+	endReasonHost      = "ended-by-host"
+	endReasonIdle      = "idle"
+	endReasonCancelled = "cancelled"
+)
+
+const defaultMeetingIdleTimeout = 5 * time.Minute
+
+// meetingIdleTimeout is how long an empty live meeting waits before ending
+var meetingIdleTimeout = defaultMeetingIdleTimeout
+
+var (
+	errMeetingEnded     = errors.New("meeting has ended")
+	errMeetingCancelled = errors.New("meeting was cancelled")
+	errMeetingNotLive   = errors.New("meeting is not live")
+	errMeetingStarted   = errors.New("meeting has already started")
+)
+
+// MeetingEnd asks the hub to close every connection in a meeting, on all
+// nodes, after sending them Message
+type MeetingEnd struct {
+	MeetingID string
+	Message   []byte
+}
+
+// loadMeetingIdleTimeout reads MEETING_IDLE_TIMEOUT from the environment
+func loadMeetingIdleTimeout() (time.Duration, error) {
+	value := os.Getenv("MEETING_IDLE_TIMEOUT")
+	if value == "" {
+		return defaultMeetingIdleTimeout, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid MEETING_IDLE_TIMEOUT %q", value)
+	}
+	return parsed, nil
+}
+
+// closedError reports why nobody can join the meeting, or nil if they can
+func (m *Meeting) closedError() error {
+	switch m.Status {
+	case meetingStatusEnded:
+		return errMeetingEnded
+	case meetingStatusCancelled:
+		return errMeetingCancelled
+	}
+	return nil
+}
+
+// reusable meetings return to scheduled when they end
+func (m *Meeting) reusable() bool {
+	return m.Personal || m.RRule != ""
+}
+
+// markMeetingLive moves a meeting to live when its first participant
+// arrives. It is a no-op if another node got there first.
+func markMeetingLive(meetingID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{
+			"meeting_id": meetingID,
+			"status":     bson.M{"$nin": []string{meetingStatusLive, meetingStatusEnded, meetingStatusCancelled}},
+		},
+		bson.M{
+			"$set":   bson.M{"status": meetingStatusLive, "started_at": now},
+			"$unset": bson.M{"ended_at": "", "duration_seconds": ""},
+		},
+	)
+	if err != nil {
+		log.Printf("Failed to mark meeting %s live: %v", meetingID, err)
+	}
+}
+
+// endMeeting ends a live meeting, records how long it ran and disconnects
+// everyone in it. actorID is empty when the meeting ended by itself.
+func endMeeting(meeting *Meeting, actorID, reason string) error {
+	if meeting.Status != meetingStatusLive {
+		return errMeetingNotLive
+	}
+
+	now := time.Now()
+	update := bson.M{"ended_at": now, "status": meetingStatusEnded}
+	if meeting.reusable() {
+		update["status"] = meetingStatusScheduled
+		// The lock and waiting room admissions last one sitting, not the
+		// life of the room. Bans stay until a host lifts them.
+		update["locked"] = false
+		update["admitted_users"] = []string{}
+	}
+	if meeting.StartedAt != nil {
+		update["duration_seconds"] = int64(now.Sub(*meeting.StartedAt).Seconds())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Filtered on the status so two nodes ending it at once only end it once
+	result, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID, "status": meetingStatusLive},
+		bson.M{"$set": update},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return errMeetingNotLive
+	}
+
+	meeting.Status = update["status"].(string)
+	meeting.EndedAt = &now
+	if meeting.reusable() {
+		meeting.Locked = false
+		meeting.AdmittedUsers = []string{}
+	}
+	if duration, ok := update["duration_seconds"].(int64); ok {
+		meeting.DurationSeconds = duration
+	}
+
+	log.Printf("Meeting %s ended (%s)", meeting.MeetingID, reason)
+
+	closeMeetingPolls(meeting.MeetingID)
+
+	hub.ends <- &MeetingEnd{
+		MeetingID: meeting.MeetingID,
+		Message:   meetingEndedMessage(meeting.MeetingID, actorID, reason),
+	}
+	return nil
+}
+
+// cancelMeeting calls off a meeting that has not started
+func cancelMeeting(meeting *Meeting, actorID string) error {
+	if meeting.Status == meetingStatusLive {
+		return errMeetingStarted
+	}
+	if err := meeting.closedError(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{
+			"meeting_id": meeting.MeetingID,
+			"status":     bson.M{"$nin": []string{meetingStatusLive, meetingStatusEnded, meetingStatusCancelled}},
+		},
+		bson.M{"$set": bson.M{"status": meetingStatusCancelled}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return errMeetingStarted
+	}
+	meeting.Status = meetingStatusCancelled
+
+	// Turn away anyone already waiting in the lobby
+	hub.ends <- &MeetingEnd{
+		MeetingID: meeting.MeetingID,
+		Message:   meetingEndedMessage(meeting.MeetingID, actorID, endReasonCancelled),
+	}
+	return nil
+}
+
+func meetingEndedMessage(meetingID, actorID, reason string) []byte {
+	encoded, err := json.Marshal(WebSocketMessage{
+		Type:      "meeting-ended",
+		Data:      map[string]string{"reason": reason},
+		UserID:    actorID,
+		MeetingID: meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("Failed to marshal meeting-ended event: %v", err)
+		return nil
+	}
+	return encoded
+}
+
+func (h *Hub) handleEnd(end *MeetingEnd) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.endLocked(end.MeetingID, end.Message)
+	h.publish(&BackplaneEnvelope{Kind: envelopeEnd, MeetingID: end.MeetingID, Message: end.Message})
+}
+
+// endLocked sends every local connection in a meeting, waiting or admitted,
+// its final message and closes it. The writes happen off the hub so a
+// stalled client cannot hold it up. Caller must hold h.mutex.
+func (h *Hub) endLocked(meetingID string, message []byte) {
+	for _, conn := range h.meetings[meetingID] {
+		h.forgetLocked(conn)
+		go conn.closeAfter(message, "meeting-ended")
+	}
+	for _, conn := range h.lobby[meetingID] {
+		h.leaveLobbyLocked(conn)
+		go conn.closeAfter(message, "meeting-ended")
+	}
+
+	// Other nodes close their own connections when they get the envelope
+	delete(h.remoteParticipants, meetingID)
+	delete(h.remoteLobby, meetingID)
+	h.stopIdleTimerLocked(meetingID)
+}
+
+// scheduleIdleEndLocked ends the meeting if it is still empty after
+// meetingIdleTimeout. Caller must hold h.mutex.
+func (h *Hub) scheduleIdleEndLocked(meetingID string) {
+	h.stopIdleTimerLocked(meetingID)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(meetingIdleTimeout, func() {
+		h.mutex.Lock()
+		current := h.idleTimers[meetingID] == timer
+		if current {
+			delete(h.idleTimers, meetingID)
+		}
+		empty := len(h.meetings[meetingID]) == 0 && len(h.remoteParticipants[meetingID]) == 0
+		h.mutex.Unlock()
+
+		if !current || !empty {
+			return
+		}
+		meeting, err := loadMeeting(meetingID)
+		if err != nil {
+			log.Printf("Failed to load idle meeting %s: %v", meetingID, err)
+			return
+		}
+		if err := endMeeting(meeting, "", endReasonIdle); err != nil && err != errMeetingNotLive {
+			log.Printf("Failed to end idle meeting %s: %v", meetingID, err)
+		}
+	})
+	h.idleTimers[meetingID] = timer
+}
+
+// stopIdleTimerLocked cancels a pending idle end. Caller must hold h.mutex.
+func (h *Hub) stopIdleTimerLocked(meetingID string) {
+	if timer, exists := h.idleTimers[meetingID]; exists {
+		timer.Stop()
+		delete(h.idleTimers, meetingID)
+	}
+}
+
+// writeFinal writes data straight to the socket, ahead of the send queue,
+// for a connection that is about to be closed
+func (c *Connection) writeFinal(data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ws == nil {
+		return
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Printf("Failed to send final message to user %s: %v", c.userID, err)
+	}
+}
+
+// closeAfter sends a connection its last message, if any, and a close
+// frame, then closes it. The writes can take up to writeWait each, so the
+// hub calls it on its own goroutine.
+func (c *Connection) closeAfter(data []byte, reason string) {
+	if data != nil {
+		c.writeFinal(data)
+	}
+	c.closeWithReason(reason)
+	c.safeClose()
+}
+
+func (c *Connection) handleEndMeeting() {
+	meeting, err := loadMeeting(c.meetingID)
+	if err != nil {
+		c.sendError("Meeting not found")
+		return
+	}
+	if !isMeetingHost(meeting, c.userID) {
+		c.sendError(errNotHost.Error())
+		return
+	}
+	if err := endMeeting(meeting, c.userID, endReasonHost); err != nil {
+		c.sendError(err.Error())
+	}
+}
+
+// meetingStateHandler serves POST /meeting/:id/end and /cancel
+func meetingStateHandler(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*Claims)
+
+		meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+		if !ok {
+			return
+		}
+
+		var err error
+		message := "Meeting ended"
+		switch action {
+		case "end":
+			err = endMeeting(meeting, claims.UserID, endReasonHost)
+		case "cancel":
+			err = cancelMeeting(meeting, claims.UserID)
+			message = "Meeting cancelled"
+		}
+
+		switch err {
+		case nil:
+		case errMeetingNotLive, errMeetingStarted, errMeetingEnded, errMeetingCancelled:
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		default:
+			c.JSON(500, gin.H{"error": "Failed to update meeting"})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"message": message,
+			"meeting": meeting,
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const leaveReasonDenied = "denied"
+
+// LobbyDecision admits or denies users waiting to enter a meeting
+type LobbyDecision struct {
+	MeetingID string
+	UserIDs   []string
+	All       bool // applies to everyone waiting, UserIDs is ignored
+	Admit     bool
+	Reason    string
+}
+
+// enterLobbyLocked holds conn in the meeting's waiting room, where it gets
+// no room traffic until a host decides. Caller must hold h.mutex.
+func (h *Hub) enterLobbyLocked(conn *Connection) {
+	if h.lobby[conn.meetingID] == nil {
+		h.lobby[conn.meetingID] = make(map[string]*Connection)
+	}
+	if existingConn, exists := h.lobby[conn.meetingID][conn.userID]; exists {
+		existingConn.safeClose()
+	}
+
+	conn.joinedAt = time.Now()
+	h.lobby[conn.meetingID][conn.userID] = conn
+
+	log.Printf("User %s is waiting in the lobby of meeting %s", conn.userID, conn.meetingID)
+
+	conn.sendMessage(WebSocketMessage{
+		Type:      "lobby-waiting",
+		MeetingID: conn.meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+
+	participant := conn.participant()
+	h.publish(&BackplaneEnvelope{Kind: envelopeLobbyJoin, MeetingID: conn.meetingID, Participant: &participant})
+	h.notifyHostsLocked(conn.meetingID)
+}
+
+// leaveLobbyLocked forgets a waiting connection. It reports false if conn
+// was not waiting. Caller must hold h.mutex.
+func (h *Hub) leaveLobbyLocked(conn *Connection) bool {
+	waiting, exists := h.lobby[conn.meetingID]
+	if !exists || waiting[conn.userID] != conn {
+		return false
+	}
+
+	delete(waiting, conn.userID)
+	if len(waiting) == 0 {
+		delete(h.lobby, conn.meetingID)
+	}
+
+	participant := conn.participant()
+	h.publish(&BackplaneEnvelope{Kind: envelopeLobbyLeave, MeetingID: conn.meetingID, Participant: &participant})
+	h.notifyHostsLocked(conn.meetingID)
+	return true
+}
+
+func (h *Hub) handleLobbyDecision(decision *LobbyDecision) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.applyLobbyDecisionLocked(decision)
+
+	// Some of the waiting users may be held by other nodes
+	h.publish(&BackplaneEnvelope{
+		Kind:      envelopeLobbyDecision,
+		MeetingID: decision.MeetingID,
+		Decision:  decision,
+	})
+}
+
+// applyLobbyDecisionLocked admits or denies the matching users waiting on
+// this node. Caller must hold h.mutex.
+func (h *Hub) applyLobbyDecisionLocked(decision *LobbyDecision) {
+	var selected []*Connection
+	if decision.All {
+		for _, conn := range h.lobby[decision.MeetingID] {
+			selected = append(selected, conn)
+		}
+	} else {
+		for _, userID := range decision.UserIDs {
+			if conn, exists := h.lobby[decision.MeetingID][userID]; exists {
+				selected = append(selected, conn)
+			}
+		}
+	}
+
+	for _, conn := range selected {
+		h.leaveLobbyLocked(conn)
+		if decision.Admit {
+			conn.inLobby.Store(false)
+			conn.sendMessage(WebSocketMessage{
+				Type:      "lobby-admitted",
+				MeetingID: conn.meetingID,
+				Timestamp: time.Now().Format(time.RFC3339),
+			})
+			h.joinLocked(conn)
+			continue
+		}
+
+		log.Printf("User %s was denied entry to meeting %s", conn.userID, conn.meetingID)
+		reason := decision.Reason
+		if reason == "" {
+			reason = leaveReasonDenied
+		}
+		go conn.closeAfter(nil, reason)
+	}
+}
+
+// lobbyLocked lists everyone waiting to enter a meeting on any node.
+// Caller must hold h.mutex.
+func (h *Hub) lobbyLocked(meetingID string) []Participant {
+	waiting := make([]Participant, 0, len(h.lobby[meetingID])+len(h.remoteLobby[meetingID]))
+	for _, conn := range h.lobby[meetingID] {
+		waiting = append(waiting, conn.participant())
+	}
+	for _, entry := range h.remoteLobby[meetingID] {
+		waiting = append(waiting, entry.participant)
+	}
+	return waiting
+}
+
+func (h *Hub) lobbyParticipants(meetingID string) []Participant {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.lobbyLocked(meetingID)
+}
+
+// notifyHostsLocked sends this node's hosts the current waiting list.
+// Caller must hold h.mutex.
+func (h *Hub) notifyHostsLocked(meetingID string) {
+	update := WebSocketMessage{
+		Type:      "lobby-update",
+		Data:      h.lobbyLocked(meetingID),
+		MeetingID: meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	for _, conn := range h.meetings[meetingID] {
+		if conn.isHost {
+			conn.sendMessage(update)
+		}
+	}
+}
+
+func (h *Hub) addRemoteLobbyLocked(nodeID, meetingID string, participant Participant) {
+	if h.remoteLobby[meetingID] == nil {
+		h.remoteLobby[meetingID] = make(map[string]remoteParticipant)
+	}
+	h.remoteLobby[meetingID][participant.UserID] = remoteParticipant{nodeID: nodeID, participant: participant}
+	h.notifyHostsLocked(meetingID)
+}
+
+func (h *Hub) removeRemoteLobbyLocked(nodeID, meetingID, userID string) {
+	entry, exists := h.remoteLobby[meetingID][userID]
+	if !exists || entry.nodeID != nodeID {
+		return
+	}
+	delete(h.remoteLobby[meetingID], userID)
+	if len(h.remoteLobby[meetingID]) == 0 {
+		delete(h.remoteLobby, meetingID)
+	}
+	h.notifyHostsLocked(meetingID)
+}
+
+// decideLobby lets a host admit or deny waiting users. Admitted users are
+// remembered so they skip the lobby when they reconnect.
+func decideLobby(meeting *Meeting, actorID string, decision *LobbyDecision) error {
+	if !isMeetingHost(meeting, actorID) {
+		return errNotHost
+	}
+	if !decision.All && len(decision.UserIDs) == 0 {
+		return errInvalidTarget
+	}
+	decision.MeetingID = meeting.MeetingID
+
+	if decision.Admit {
+		admitted := decision.UserIDs
+		if decision.All {
+			admitted = nil
+			for _, participant := range hub.lobbyParticipants(meeting.MeetingID) {
+				admitted = append(admitted, participant.UserID)
+			}
+		}
+		if len(admitted) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := db.Collection("meetings").UpdateOne(
+				ctx,
+				bson.M{"meeting_id": meeting.MeetingID},
+				bson.M{"$addToSet": bson.M{"admitted_users": bson.M{"$each": admitted}}},
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	hub.lobbyDecisions <- decision
+	return nil
+}
+
+// setWaitingRoom turns the waiting room on or off. Turning it off lets
+// everyone who is waiting in.
+func setWaitingRoom(meeting *Meeting, actorID string, enabled bool) error {
+	if !isMeetingHost(meeting, actorID) {
+		return errNotHost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{"$set": bson.M{"waiting_room_enabled": enabled}},
+	)
+	if err != nil {
+		return err
+	}
+	meeting.WaitingRoomEnabled = enabled
+
+	if !enabled {
+		if err := decideLobby(meeting, actorID, &LobbyDecision{All: true, Admit: true}); err != nil {
+			return err
+		}
+	}
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:      "waiting-room-updated",
+		Data:      map[string]bool{"enabled": enabled},
+		UserID:    actorID,
+		MeetingID: meeting.MeetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// needsLobby reports whether userID has to wait for a host to let them in
+func needsLobby(meeting *Meeting, userID string) bool {
+	return meeting.WaitingRoomEnabled &&
+		!isMeetingHost(meeting, userID) &&
+		!containsString(meeting.AdmittedUsers, userID)
+}
+
+// recordParticipant adds userID to the meeting's participants once they are
+// in the meeting itself, which is what lets them read its chat, files and
+// polls afterwards. Anyone still waiting or turned away never gets there.
+func recordParticipant(meetingID, userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meetingID},
+		bson.M{"$addToSet": bson.M{"participants": userID}},
+	)
+	if err != nil {
+		log.Printf("Failed to record user %s as a participant in meeting %s: %v", userID, meetingID, err)
+	}
+}
+
+func (c *Connection) handleLobbyCommand(msg WebSocketMessage) {
+	meeting, err := loadMeeting(c.meetingID)
+	if err != nil {
+		c.sendError("Meeting not found")
+		return
+	}
+
+	var data struct {
+		UserIDs []string `json:"userIds"`
+		All     bool     `json:"all"`
+		Reason  string   `json:"reason"`
+		Enabled bool     `json:"enabled"`
+	}
+	if msg.Data != nil {
+		if err := decodeData(msg.Data, &data); err != nil {
+			c.sendError("Invalid lobby command")
+			return
+		}
+	}
+	if msg.TargetUserID != "" {
+		data.UserIDs = append(data.UserIDs, msg.TargetUserID)
+	}
+
+	switch msg.Type {
+	case "lobby-admit", "lobby-deny":
+		err = decideLobby(meeting, c.userID, &LobbyDecision{
+			UserIDs: data.UserIDs,
+			All:     data.All,
+			Admit:   msg.Type == "lobby-admit",
+			Reason:  data.Reason,
+		})
+	case "waiting-room":
+		err = setWaitingRoom(meeting, c.userID, data.Enabled)
+	}
+	if err != nil {
+		c.sendError(err.Error())
+	}
+}
+
+// lobbyHandler lets a host admit or deny waiting users over REST
+func lobbyHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	var lobbyData struct {
+		Action  string   `json:"action"`
+		UserIDs []string `json:"userIds"`
+		All     bool     `json:"all"`
+		Reason  string   `json:"reason"`
+	}
+
+	if err := c.ShouldBindJSON(&lobbyData); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if lobbyData.Action != "admit" && lobbyData.Action != "deny" {
+		c.JSON(400, gin.H{"error": "action must be admit or deny"})
+		return
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+
+	err := decideLobby(meeting, claims.UserID, &LobbyDecision{
+		UserIDs: lobbyData.UserIDs,
+		All:     lobbyData.All,
+		Admit:   lobbyData.Action == "admit",
+		Reason:  lobbyData.Reason,
+	})
+	switch err {
+	case nil:
+	case errNotHost:
+		c.JSON(403, gin.H{"error": err.Error()})
+		return
+	case errInvalidTarget:
+		c.JSON(400, gin.H{"error": "userIds or all is required"})
+		return
+	default:
+		c.JSON(500, gin.H{"error": "Failed to update lobby"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Lobby updated"})
+}
+
+// getLobbyHandler lists who is waiting, for hosts only
+func getLobbyHandler(c *gin.Context) {
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, gin.H{"waiting": hub.lobbyParticipants(meeting.MeetingID)})
+}
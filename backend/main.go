@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -16,6 +19,7 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/pion/webrtc/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -39,7 +43,30 @@ type Meeting struct {
 	CreatedBy    primitive.ObjectID `bson:"created_by" json:"created_by"`
 	Participants []string           `bson:"participants" json:"participants"`
 	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
-	IsActive     bool               `bson:"is_active" json:"is_active"`
+	Status       string             `bson:"status" json:"status"`
+	MediaMode    string             `bson:"media_mode" json:"media_mode"`
+	CoHosts      []string           `bson:"co_hosts" json:"co_hosts"`
+	BannedUsers  []string           `bson:"banned_users" json:"banned_users"`
+	Locked       bool               `bson:"locked" json:"locked"`
+
+	WaitingRoomEnabled  bool     `bson:"waiting_room_enabled" json:"waiting_room_enabled"`
+	AdmittedUsers       []string `bson:"admitted_users" json:"admitted_users"`
+	PasscodeHash        string   `bson:"passcode_hash" json:"-"`
+	Personal            bool     `bson:"personal" json:"personal"` // reserved vanity room
+	PrivateChatDisabled bool     `bson:"private_chat_disabled" json:"private_chat_disabled"`
+
+	// Scheduling, all unset for an ad hoc meeting
+	StartTime  *time.Time            `bson:"start_time,omitempty" json:"start_time,omitempty"`
+	EndTime    *time.Time            `bson:"end_time,omitempty" json:"end_time,omitempty"`
+	TimeZone   string                `bson:"time_zone,omitempty" json:"time_zone,omitempty"`
+	RRule      string                `bson:"rrule,omitempty" json:"rrule,omitempty"`
+	Invitees   []string              `bson:"invitees,omitempty" json:"invitees,omitempty"`
+	Exceptions []OccurrenceException `bson:"exceptions,omitempty" json:"exceptions,omitempty"`
+
+	// When it last went live and ended
+	StartedAt       *time.Time `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	EndedAt         *time.Time `bson:"ended_at,omitempty" json:"ended_at,omitempty"`
+	DurationSeconds int64      `bson:"duration_seconds,omitempty" json:"duration_seconds,omitempty"`
 }
 
 type ChatMessage struct {
@@ -50,30 +77,96 @@ type ChatMessage struct {
 	UserEmail string             `bson:"user_email" json:"user_email"`
 	Message   string             `bson:"message" json:"message"`
 	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+
+	Visibility  string `bson:"visibility,omitempty" json:"visibility,omitempty"`
+	RecipientID string `bson:"recipient_id,omitempty" json:"recipient_id,omitempty"` // private messages only
+
+	Attachment *ChatAttachment `bson:"attachment,omitempty" json:"attachment,omitempty"`
+
+	// Replies point at the message that started their thread, which counts them
+	ParentID   *primitive.ObjectID `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	ReplyCount int                 `bson:"reply_count,omitempty" json:"reply_count,omitempty"`
+	// emoji -> IDs of the users who reacted with it
+	Reactions      map[string][]string `bson:"reactions,omitempty" json:"reactions,omitempty"`
+	ReactionCounts map[string]int      `bson:"-" json:"reaction_counts,omitempty"`
+
+	// Edits keep the earlier text. A deleted message stays as a tombstone
+	// with its text cleared.
+	EditedAt  *time.Time     `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	Revisions []ChatRevision `bson:"revisions,omitempty" json:"revisions,omitempty"`
+	Deleted   bool           `bson:"deleted,omitempty" json:"deleted,omitempty"`
+	DeletedBy string         `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+	DeletedAt *time.Time     `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
 }
 
 // Connection structure with better management
 type Connection struct {
+	hub        *Hub
 	ws         *websocket.Conn
 	userID     string
 	userName   string
 	userEmail  string
 	meetingID  string
+	mediaMode  string
+	sessionID  primitive.ObjectID // attendance session of the current join
+	isHost     bool               // guarded by h.mutex once registered
+	inLobby    atomic.Bool        // waiting for a host to admit them
+	joinedAt   time.Time
 	send       chan []byte
 	mutex      sync.Mutex
+	sendMutex  sync.Mutex // guards send against use after close
 	closed     bool
 	sendClosed bool
 	closeOnce  sync.Once
+
+	// Only touched by the read pump
+	lastTypingStart time.Time
+	lastReadID      primitive.ObjectID
 }
 
 // Hub with improved connection management
 type Hub struct {
 	// meetingID -> userID -> connection
-	meetings    map[string]map[string]*Connection
-	register    chan *Connection
-	unregister  chan *Connection
-	broadcast   chan *BroadcastMessage
-	mutex       sync.RWMutex
+	meetings   map[string]map[string]*Connection
+	register   chan *Connection
+	unregister chan *Connection
+	broadcast  chan *BroadcastMessage
+	direct     chan *DirectMessage
+	kick       chan *KickRequest
+	mutex      sync.RWMutex
+
+	// Co-host grants and revocations for connections already in a meeting
+	hostChanges chan *HostChange
+
+	// meetingID -> userID -> connection waiting to be admitted
+	lobby          map[string]map[string]*Connection
+	lobbyDecisions chan *LobbyDecision
+
+	ends     chan *MeetingEnd
+	sessions chan *sessionEvent
+	// meetingID -> pending end of a meeting that emptied
+	idleTimers map[string]*time.Timer
+
+	typing chan *TypingEvent
+	// meetingID -> userID -> expiry of a local user's typing indicator
+	typists map[string]map[string]*time.Timer
+
+	// Traffic shared with hubs on other nodes
+	nodeID    string
+	backplane Backplane
+	remote    chan *BackplaneEnvelope
+	outbound  chan *BackplaneEnvelope
+	// meetingID -> userID -> participant connected to another node
+	remoteParticipants map[string]map[string]remoteParticipant
+	remoteLobby        map[string]map[string]remoteParticipant
+	nodesSeen          map[string]time.Time
+}
+
+// Participant is a connected user as reported in presence events
+type Participant struct {
+	UserID   string    `json:"userId"`
+	UserName string    `json:"userName"`
+	JoinedAt time.Time `json:"joinedAt"`
 }
 
 type BroadcastMessage struct {
@@ -83,6 +176,16 @@ type BroadcastMessage struct {
 	MessageType   string
 }
 
+// DirectMessage is delivered to a single user in a meeting. If the target
+// is not connected the sender gets an error frame back.
+type DirectMessage struct {
+	MeetingID    string
+	TargetUserID string
+	Message      []byte
+	MessageType  string
+	Sender       *Connection
+}
+
 type WebSocketMessage struct {
 	Type      string      `json:"type"`
 	Data      interface{} `json:"data"`
@@ -92,13 +195,24 @@ type WebSocketMessage struct {
 	MeetingID string      `json:"meetingId"`
 	Timestamp string      `json:"timestamp"`
 	ID        string      `json:"id,omitempty"`
+
+	// Only read from the first-frame auth message, never relayed
+	Token string `json:"token,omitempty"`
+
+	TargetUserID string `json:"targetUserId,omitempty"`
+	RecipientID  string `json:"recipientId,omitempty"` // private chat
+
+	// Shared files in chat events
+	Attachment *ChatAttachment `json:"attachment,omitempty"`
+	Upload     *UploadProgress `json:"upload,omitempty"`
 }
 
 // Global variables
 var (
-	db       *mongo.Database
-	hub      *Hub
-	upgrader = websocket.Upgrader{
+	db          *mongo.Database
+	hub         *Hub
+	mediaServer *SFU
+	upgrader    = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			allowedOrigins := strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",")
 			origin := r.Header.Get("Origin")
@@ -129,6 +243,14 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = 45 * time.Second
 	writeWait      = 10 * time.Second
+	authWait       = 10 * time.Second // time allowed for a first-frame auth message
+)
+
+// Reasons reported in participant-left events
+const (
+	leaveReasonDisconnected = "disconnected"
+	leaveReasonBufferFull   = "buffer-full"
+	leaveReasonStale        = "stale"
 )
 
 func main() {
@@ -171,21 +293,79 @@ func main() {
 	db = client.Database(os.Getenv("MONGODB_DATABASE"))
 	fmt.Println("Connected to MongoDB!")
 
-	// Initialize WebSocket Hub
-	hub = &Hub{
-		meetings:   make(map[string]map[string]*Connection),
-		register:   make(chan *Connection, 100),
-		unregister: make(chan *Connection, 100),
-		broadcast:  make(chan *BroadcastMessage, 1000),
+	// Meeting IDs must be unique for collision checks to work, so there is
+	// no running without the index
+	if err := ensureMeetingIndexes(ctx); err != nil {
+		log.Fatal("Failed to create meeting indexes:", err)
+	}
+	if err := ensureAttendanceIndexes(ctx); err != nil {
+		log.Printf("Failed to create attendance indexes: %v", err)
+	}
+	if err := ensureChatIndexes(ctx); err != nil {
+		log.Printf("Failed to create chat indexes: %v", err)
+	}
+	if err := ensureReadMarkerIndexes(ctx); err != nil {
+		log.Printf("Failed to create read marker indexes: %v", err)
+	}
+	if err := ensurePollIndexes(ctx); err != nil {
+		log.Printf("Failed to create poll indexes: %v", err)
+	}
+	if err := ensureQuestionIndexes(ctx); err != nil {
+		log.Printf("Failed to create question indexes: %v", err)
+	}
+	if err := ensureAuditIndexes(ctx); err != nil {
+		log.Printf("Failed to create audit indexes: %v", err)
+	}
+
+	meetingIdleTimeout, err = loadMeetingIdleTimeout()
+	if err != nil {
+		log.Fatal("Invalid meeting configuration:", err)
+	}
+
+	// Initialize WebSocket Hub and the backplane it shares meetings over
+	backplane, err := newBackplaneFromEnv()
+	if err != nil {
+		log.Fatal("Failed to connect backplane:", err)
+	}
+	defer backplane.Close()
+
+	hub, err = newHub(newNodeID(), backplane)
+	if err != nil {
+		log.Fatal("Failed to subscribe to backplane:", err)
 	}
 	go hub.run()
+	go hub.publishLoop()
+	go hub.heartbeatLoop()
+	go hub.sessionLoop()
 
 	// Start cleanup routine
 	go hub.cleanupInactiveConnections()
 
-	// Initialize Gin router
-	r := gin.Default()
-	
+	// Initialize the SFU used by meetings in sfu media mode
+	mediaServer, err = newSFU(webrtc.Configuration{}, os.Getenv("SFU_PUBLIC_IP"))
+	if err != nil {
+		log.Fatal("Failed to initialize SFU:", err)
+	}
+	defer mediaServer.Close()
+
+	// Start the embedded TURN/STUN server if configured
+	turnSettings, err = loadTURNSettings()
+	if err != nil {
+		log.Fatal("Invalid TURN configuration:", err)
+	}
+	if turnSettings.enabled() {
+		turnServer, err := startTURNServer(turnSettings)
+		if err != nil {
+			log.Fatal("Failed to start TURN server:", err)
+		}
+		defer turnServer.Close()
+	}
+
+	// Initialize Gin router. gin's own logger would write query strings,
+	// credentials and all, so only loggingMiddleware logs requests.
+	r := gin.New()
+	r.Use(gin.Recovery())
+
 	// CORS configuration
 	config := cors.DefaultConfig()
 	config.AllowOrigins = strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",")
@@ -209,7 +389,38 @@ func main() {
 		api.POST("/meeting", authMiddleware(), createMeetingHandler)
 		api.POST("/meeting/join", authMiddleware(), joinMeetingHandler)
 		api.GET("/meeting/:id", authMiddleware(), getMeetingHandler)
+		api.GET("/meeting/:id/ics", authMiddleware(), icsHandler)
+		api.POST("/meeting/:id/occurrences", authMiddleware(), occurrenceHandler)
+		api.POST("/meeting/:id/end", authMiddleware(), meetingStateHandler("end"))
+		api.POST("/meeting/:id/cancel", authMiddleware(), meetingStateHandler("cancel"))
+		api.GET("/meeting/:id/attendance", authMiddleware(), attendanceHandler)
+		api.GET("/meetings/upcoming", authMiddleware(), upcomingMeetingsHandler)
+		api.POST("/meeting/:id/recording", authMiddleware(), recordingHandler)
+		api.POST("/meeting/:id/mute", authMiddleware(), moderationHandler("mute"))
+		api.POST("/meeting/:id/remove", authMiddleware(), moderationHandler("remove"))
+		api.POST("/meeting/:id/unban", authMiddleware(), moderationHandler("unban"))
+		api.POST("/meeting/:id/lock", authMiddleware(), moderationHandler("lock"))
+		api.POST("/meeting/:id/cohosts", authMiddleware(), moderationHandler("cohosts"))
+		api.GET("/meeting/:id/lobby", authMiddleware(), getLobbyHandler)
+		api.POST("/meeting/:id/lobby", authMiddleware(), lobbyHandler)
+		api.POST("/meeting/:id/waiting-room", authMiddleware(), moderationHandler("waiting-room"))
+		api.POST("/meeting/:id/private-chat", authMiddleware(), moderationHandler("private-chat"))
+		api.POST("/meeting/:id/files", authMiddleware(), uploadFileHandler)
+		api.GET("/meeting/:id/polls", authMiddleware(), getPollsHandler)
+		api.GET("/meeting/:id/questions", authMiddleware(), questionsHandler)
+		api.GET("/files/:id", authMiddleware(), downloadFileHandler)
+		api.POST("/meeting/:id/passcode", authMiddleware(), setPasscodeHandler)
+		api.POST("/meeting/:id/invites", authMiddleware(), createInviteHandler)
+		api.GET("/meeting/:id/invites", authMiddleware(), listInvitesHandler)
+		api.DELETE("/meeting/:id/invites/:inviteId", authMiddleware(), revokeInviteHandler)
+		api.GET("/chat/search", authMiddleware(), searchChatHandler)
 		api.GET("/chat/:meetingId", authMiddleware(), getChatMessagesHandler)
+		api.GET("/chat/:meetingId/export", authMiddleware(), exportChatHandler)
+		api.PATCH("/chat/:meetingId/messages/:messageId", authMiddleware(), chatMessageHandler)
+		api.DELETE("/chat/:meetingId/messages/:messageId", authMiddleware(), chatMessageHandler)
+		api.GET("/ice-servers", authMiddleware(), iceServersHandler)
+		api.POST("/rooms", authMiddleware(), reserveRoomHandler)
+		api.GET("/rooms", authMiddleware(), listRoomsHandler)
 		api.GET("/ws", wsHandler)
 	}
 
@@ -259,7 +470,7 @@ func loggingMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
 		path := c.Request.URL.Path
-		raw := c.Request.URL.RawQuery
+		raw := redactQuery(c.Request.URL.Query())
 
 		c.Next()
 
@@ -283,6 +494,54 @@ func loggingMiddleware() gin.HandlerFunc {
 	}
 }
 
+// Query parameters that carry credentials, never written to the logs
+var sensitiveQueryParams = []string{"token", "passcode", "invite"}
+
+func redactQuery(query url.Values) string {
+	for _, key := range sensitiveQueryParams {
+		if query.Has(key) {
+			query.Set(key, "REDACTED")
+		}
+	}
+	return query.Encode()
+}
+
+// newHub creates a hub identified as nodeID on the backplane. The caller
+// starts its goroutines.
+func newHub(nodeID string, backplane Backplane) (*Hub, error) {
+	h := &Hub{
+		meetings:           make(map[string]map[string]*Connection),
+		register:           make(chan *Connection, 100),
+		unregister:         make(chan *Connection, 100),
+		broadcast:          make(chan *BroadcastMessage, 1000),
+		direct:             make(chan *DirectMessage, 1000),
+		kick:               make(chan *KickRequest, 100),
+		hostChanges:        make(chan *HostChange, 100),
+		lobby:              make(map[string]map[string]*Connection),
+		lobbyDecisions:     make(chan *LobbyDecision, 100),
+		ends:               make(chan *MeetingEnd, 100),
+		sessions:           make(chan *sessionEvent, 1000),
+		idleTimers:         make(map[string]*time.Timer),
+		typing:             make(chan *TypingEvent, 1000),
+		typists:            make(map[string]map[string]*time.Timer),
+		remote:             make(chan *BackplaneEnvelope, 1000),
+		outbound:           make(chan *BackplaneEnvelope, 1000),
+		nodeID:             nodeID,
+		backplane:          backplane,
+		remoteParticipants: make(map[string]map[string]remoteParticipant),
+		remoteLobby:        make(map[string]map[string]remoteParticipant),
+		nodesSeen:          make(map[string]time.Time),
+	}
+
+	err := backplane.Subscribe(func(env *BackplaneEnvelope) {
+		h.remote <- env
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
 // Hub methods with improved connection management
 func (h *Hub) run() {
 	defer func() {
@@ -299,6 +558,20 @@ func (h *Hub) run() {
 			h.handleUnregister(conn)
 		case msg := <-h.broadcast:
 			h.handleBroadcast(msg)
+		case msg := <-h.direct:
+			h.handleDirect(msg)
+		case req := <-h.kick:
+			h.handleKick(req)
+		case change := <-h.hostChanges:
+			h.handleHostChange(change)
+		case decision := <-h.lobbyDecisions:
+			h.handleLobbyDecision(decision)
+		case end := <-h.ends:
+			h.handleEnd(end)
+		case event := <-h.typing:
+			h.handleTyping(event)
+		case env := <-h.remote:
+			h.handleRemote(env)
 		}
 	}
 }
@@ -307,6 +580,21 @@ func (h *Hub) handleRegister(conn *Connection) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	// The read pump may already have given up before we got here
+	if conn.isClosed() {
+		return
+	}
+
+	if conn.inLobby.Load() {
+		h.enterLobbyLocked(conn)
+		return
+	}
+	h.joinLocked(conn)
+}
+
+// joinLocked adds conn to its meeting and announces it to the room.
+// Caller must hold h.mutex.
+func (h *Hub) joinLocked(conn *Connection) {
 	// Initialize meeting map if doesn't exist
 	if h.meetings[conn.meetingID] == nil {
 		h.meetings[conn.meetingID] = make(map[string]*Connection)
@@ -317,57 +605,185 @@ func (h *Hub) handleRegister(conn *Connection) {
 		log.Printf("Closing existing connection for user %s in meeting %s", conn.userID, conn.meetingID)
 		existingConn.safeClose()
 		delete(h.meetings[conn.meetingID], conn.userID)
+		// Its unregister will find it already replaced, so end its session here
+		h.logSessionLocked(existingConn, true)
 	}
 
+	// A connection on another node is closed by that node when it sees our join
+	delete(h.remoteParticipants[conn.meetingID], conn.userID)
+
+	// Send the newcomer everyone already present before announcing them
+	conn.sendMessage(WebSocketMessage{
+		Type:      "roster",
+		Data:      h.participantsLocked(conn.meetingID),
+		MeetingID: conn.meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+
 	// Register new connection
+	conn.joinedAt = time.Now()
+	conn.sessionID = primitive.NewObjectID()
 	h.meetings[conn.meetingID][conn.userID] = conn
-	
-	log.Printf("User %s connected to meeting %s. Total connections in meeting: %d", 
+	h.logSessionLocked(conn, false)
+	go recordParticipant(conn.meetingID, conn.userID)
+	go conn.sendUnreadCount()
+	go conn.sendQuestionQueue()
+	// Not under h.mutex: startRecording holds the recordings lock while
+	// reading the hub
+	go conn.sendRecordingState()
+
+	// The first one in takes the meeting live
+	h.stopIdleTimerLocked(conn.meetingID)
+	if len(h.meetings[conn.meetingID]) == 1 && len(h.remoteParticipants[conn.meetingID]) == 0 {
+		go markMeetingLive(conn.meetingID)
+	}
+
+	log.Printf("User %s connected to meeting %s. Total connections in meeting: %d",
 		conn.userID, conn.meetingID, len(h.meetings[conn.meetingID]))
+
+	participant := conn.participant()
+	h.fanOut(conn.meetingID, presenceMessage("participant-joined", conn.meetingID, participant, participant), conn.userID)
+	h.publish(&BackplaneEnvelope{Kind: envelopeJoin, MeetingID: conn.meetingID, Participant: &participant})
 }
 
 func (h *Hub) handleUnregister(conn *Connection) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	if meetingConns, exists := h.meetings[conn.meetingID]; exists {
-		if existingConn, userExists := meetingConns[conn.userID]; userExists && existingConn == conn {
-			delete(meetingConns, conn.userID)
-			conn.safeClose()
-			
-			// Clean up empty meeting
-			if len(meetingConns) == 0 {
-				delete(h.meetings, conn.meetingID)
-				log.Printf("Meeting %s cleaned up (no active connections)", conn.meetingID)
-			}
-			
-			log.Printf("User %s disconnected from meeting %s. Remaining connections: %d", 
-				conn.userID, conn.meetingID, len(meetingConns))
-		}
+	if h.leaveLobbyLocked(conn) {
+		conn.safeClose()
+		return
 	}
+	h.removeLocked(conn, leaveReasonDisconnected)
 }
 
 func (h *Hub) handleBroadcast(msg *BroadcastMessage) {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
-	if meetingConns, exists := h.meetings[msg.MeetingID]; exists {
-		for userID, conn := range meetingConns {
-			if userID != msg.ExcludeUserID {
-				select {
-				case conn.send <- msg.Message:
-					// Message sent successfully
-				default:
-					// Connection send buffer is full, close it
-					log.Printf("Send buffer full for user %s in meeting %s, closing connection", userID, msg.MeetingID)
-					delete(meetingConns, userID)
-					conn.safeClose()
-				}
+	h.fanOut(msg.MeetingID, msg.Message, msg.ExcludeUserID)
+	h.publish(&BackplaneEnvelope{
+		Kind:          envelopeBroadcast,
+		MeetingID:     msg.MeetingID,
+		ExcludeUserID: msg.ExcludeUserID,
+		Message:       msg.Message,
+	})
+}
+
+func (h *Hub) handleDirect(msg *DirectMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	conn, exists := h.meetings[msg.MeetingID][msg.TargetUserID]
+	if !exists {
+		// Hand it to the node the target is connected to
+		if _, remote := h.remoteParticipants[msg.MeetingID][msg.TargetUserID]; remote {
+			h.publish(&BackplaneEnvelope{
+				Kind:         envelopeDirect,
+				MeetingID:    msg.MeetingID,
+				TargetUserID: msg.TargetUserID,
+				Message:      msg.Message,
+			})
+			return
+		}
+
+		if msg.Sender != nil {
+			response := WebSocketMessage{
+				Type:         "error",
+				Data:         fmt.Sprintf("User %s is not connected to this meeting", msg.TargetUserID),
+				TargetUserID: msg.TargetUserID,
+				Timestamp:    time.Now().Format(time.RFC3339),
 			}
+			msg.Sender.sendMessage(response)
 		}
+		return
+	}
+
+	if !conn.trySend(msg.Message) {
+		log.Printf("Send buffer full for user %s in meeting %s, closing connection", msg.TargetUserID, msg.MeetingID)
+		h.removeLocked(conn, leaveReasonBufferFull)
 	}
 }
 
+// fanOut delivers data to every local connection in a meeting except
+// excludeUserID. Connections whose send buffer is full are evicted.
+// Caller must hold h.mutex.
+func (h *Hub) fanOut(meetingID string, data []byte, excludeUserID string) {
+	var evicted []*Connection
+	for userID, conn := range h.meetings[meetingID] {
+		if userID == excludeUserID {
+			continue
+		}
+		if !conn.trySend(data) {
+			log.Printf("Send buffer full for user %s in meeting %s, closing connection", userID, meetingID)
+			evicted = append(evicted, conn)
+		}
+	}
+
+	for _, conn := range evicted {
+		h.removeLocked(conn, leaveReasonBufferFull)
+	}
+}
+
+// removeLocked drops conn from its meeting, closes it and tells the rest of
+// the room why it left. Caller must hold h.mutex.
+func (h *Hub) removeLocked(conn *Connection, reason string) {
+	if !h.detachLocked(conn) {
+		return
+	}
+	h.announceLeaveLocked(conn, reason)
+}
+
+// announceLeaveLocked tells the room and the other nodes that conn, already
+// dropped from its meeting, left. Caller must hold h.mutex.
+func (h *Hub) announceLeaveLocked(conn *Connection, reason string) {
+	log.Printf("User %s left meeting %s (%s). Remaining connections: %d",
+		conn.userID, conn.meetingID, reason, len(h.meetings[conn.meetingID]))
+
+	participant := conn.participant()
+	h.fanOut(conn.meetingID, presenceMessage("participant-left", conn.meetingID, participant, map[string]string{"reason": reason}), "")
+	h.publish(&BackplaneEnvelope{Kind: envelopeLeave, MeetingID: conn.meetingID, Participant: &participant, Reason: reason})
+}
+
+// detachLocked drops conn from its meeting and closes it without telling
+// anyone. It reports false if conn was not registered. Caller must hold h.mutex.
+func (h *Hub) detachLocked(conn *Connection) bool {
+	if !h.forgetLocked(conn) {
+		return false
+	}
+	conn.safeClose()
+	return true
+}
+
+// forgetLocked is detachLocked without closing the socket, for callers that
+// still have something to write to it. Caller must hold h.mutex.
+func (h *Hub) forgetLocked(conn *Connection) bool {
+	meetingConns, exists := h.meetings[conn.meetingID]
+	if !exists || meetingConns[conn.userID] != conn {
+		return false
+	}
+
+	delete(meetingConns, conn.userID)
+	h.logSessionLocked(conn, true)
+	// participant-left tells clients to drop the indicator
+	h.clearTypingLocked(conn.meetingID, conn.userID)
+
+	if conn.mediaMode == mediaModeSFU {
+		go mediaServer.Leave(conn.meetingID, conn.userID, conn)
+	}
+
+	// Clean up empty meeting
+	if len(meetingConns) == 0 {
+		delete(h.meetings, conn.meetingID)
+		log.Printf("Meeting %s cleaned up (no active connections)", conn.meetingID)
+		go stopRecordingIfActive(conn.meetingID)
+		if len(h.remoteParticipants[conn.meetingID]) == 0 {
+			h.scheduleIdleEndLocked(conn.meetingID)
+		}
+	}
+	return true
+}
+
 func (h *Hub) cleanupInactiveConnections() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -377,82 +793,285 @@ func (h *Hub) cleanupInactiveConnections() {
 		for meetingID, meetingConns := range h.meetings {
 			for userID, conn := range meetingConns {
 				// Check if connection is closed
-				if conn.closed {
+				if conn.isClosed() {
 					log.Printf("Cleaning up closed connection for user %s in meeting %s", userID, meetingID)
-					delete(meetingConns, userID)
-					conn.safeClose()
+					h.removeLocked(conn, leaveReasonStale)
 				}
 			}
-			// Clean up empty meetings
-			if len(meetingConns) == 0 {
-				delete(h.meetings, meetingID)
-			}
 		}
 		h.mutex.Unlock()
 	}
 }
 
+// participants returns everyone in a meeting, on this node or any other
+func (h *Hub) participants(meetingID string) []Participant {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.participantsLocked(meetingID)
+}
+
+func (h *Hub) participantsLocked(meetingID string) []Participant {
+	participants := make([]Participant, 0, len(h.meetings[meetingID])+len(h.remoteParticipants[meetingID]))
+	for _, conn := range h.meetings[meetingID] {
+		participants = append(participants, conn.participant())
+	}
+	for _, entry := range h.remoteParticipants[meetingID] {
+		participants = append(participants, entry.participant)
+	}
+	return participants
+}
+
+func presenceMessage(eventType, meetingID string, participant Participant, data interface{}) []byte {
+	msg := WebSocketMessage{
+		Type:      eventType,
+		Data:      data,
+		UserID:    participant.UserID,
+		UserName:  participant.UserName,
+		MeetingID: meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", eventType, err)
+		return nil
+	}
+	return encoded
+}
+
 // WebSocket Handlers
 func wsHandler(c *gin.Context) {
-	meetingID := c.Query("meetingId")
-	userID := c.Query("userId")
+	meetingID := normalizeMeetingID(c.Query("meetingId"))
 
-	if meetingID == "" || userID == "" {
-		c.JSON(400, gin.H{"error": "Missing meetingId or userId"})
+	if meetingID == "" {
+		c.JSON(400, gin.H{"error": "Missing meetingId"})
 		return
 	}
 
+	// The token may come from the query string or the subprotocol header.
+	// If neither is present the client must send it in a first-frame auth message.
+	var claims *Claims
+	var responseHeader http.Header
+	tokenString := c.Query("token")
+	if tokenString == "" {
+		var protocol string
+		tokenString, protocol = tokenFromSubprotocols(c.Request)
+		if protocol != "" {
+			responseHeader = http.Header{"Sec-WebSocket-Protocol": {protocol}}
+		}
+	}
+	if tokenString != "" {
+		parsed, err := parseToken(tokenString)
+		if err != nil {
+			c.JSON(401, gin.H{"error": "Invalid token"})
+			return
+		}
+		claims = parsed
+	}
+
 	// Verify meeting exists
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	
+
 	var meeting Meeting
 	err := db.Collection("meetings").FindOne(ctx, bson.M{"meeting_id": meetingID}).Decode(&meeting)
 	if err != nil {
 		c.JSON(404, gin.H{"error": "Meeting not found"})
 		return
 	}
+	if err := meeting.closedError(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Turn away banned users and new joiners of a locked meeting, then
+	// check the passcode or invite
+	passcode, inviteToken := c.Query("passcode"), c.Query("invite")
+	if claims != nil {
+		if err := admissionError(&meeting, claims.UserID); err != nil {
+			c.JSON(403, gin.H{"error": err.Error()})
+			return
+		}
+		if err := checkAccess(&meeting, claims.UserID, passcode, inviteToken); err != nil {
+			if status := accessErrorStatus(err); status != 500 {
+				c.JSON(status, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(500, gin.H{"error": "Failed to check meeting access"})
+			}
+			return
+		}
+	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 
+	firstFrameAuth := claims == nil
+	if firstFrameAuth {
+		claims, err = awaitAuthFrame(conn, meetingID)
+		if err != nil {
+			log.Printf("WebSocket auth failed for meeting %s: %v", meetingID, err)
+			rejectConnection(conn, "Authentication failed")
+			return
+		}
+		if err := admissionError(&meeting, claims.UserID); err != nil {
+			rejectConnection(conn, err.Error())
+			return
+		}
+		if err := checkAccess(&meeting, claims.UserID, passcode, inviteToken); err != nil {
+			rejectConnection(conn, err.Error())
+			return
+		}
+	}
+
+	// Identity is fixed for the lifetime of the connection
 	connection := &Connection{
+		hub:       hub,
 		ws:        conn,
-		userID:    userID,
+		userID:    claims.UserID,
+		userName:  claims.Name,
+		userEmail: claims.Email,
 		meetingID: meetingID,
+		mediaMode: meeting.MediaMode,
+		isHost:    isMeetingHost(&meeting, claims.UserID),
 		send:      make(chan []byte, 256),
 	}
+	connection.inLobby.Store(needsLobby(&meeting, claims.UserID))
 
 	// Start connection handlers
 	go connection.writePump()
 	go connection.readPump()
-	
+
 	// Register connection after starting handlers
-	hub.register <- connection
+	connection.hub.register <- connection
+
+	if firstFrameAuth {
+		connection.sendAuthSuccess()
+	}
+}
+
+// tokenFromSubprotocols extracts a JWT offered as ["access_token", <jwt>] in
+// the Sec-WebSocket-Protocol header. It returns the token and the protocol
+// the server must echo back for the browser to accept the handshake.
+func tokenFromSubprotocols(r *http.Request) (string, string) {
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == "access_token" && i+1 < len(protocols) {
+			return protocols[i+1], protocol
+		}
+	}
+	return "", ""
+}
+
+// awaitAuthFrame reads the first frame of an unauthenticated connection,
+// which must be an auth message carrying the token in its token field or,
+// as older clients send it, as its data.
+func awaitAuthFrame(conn *websocket.Conn, meetingID string) (*Claims, error) {
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(authWait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var msg WebSocketMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Type != "auth" {
+		return nil, fmt.Errorf("expected auth message, got %q", msg.Type)
+	}
+	tokenString := msg.Token
+	if tokenString == "" {
+		tokenString, _ = msg.Data.(string)
+	}
+	if tokenString == "" {
+		return nil, errors.New("auth message carries no token")
+	}
+
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if (msg.UserID != "" && msg.UserID != claims.UserID) || (msg.MeetingID != "" && normalizeMeetingID(msg.MeetingID) != meetingID) {
+		return nil, errors.New("auth message identity does not match token")
+	}
+	return claims, nil
+}
+
+// rejectConnection tells the client why and closes the socket before it
+// is ever registered with the hub.
+func rejectConnection(conn *websocket.Conn, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.WriteJSON(WebSocketMessage{
+		Type:      "error",
+		Data:      reason,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+	conn.Close()
 }
 
 // Connection methods
 func (c *Connection) safeClose() {
 	c.closeOnce.Do(func() {
+		c.sendMutex.Lock()
+		c.closed = true
+		if !c.sendClosed {
+			close(c.send)
+			c.sendClosed = true
+		}
+		c.sendMutex.Unlock()
+
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
-
-		if !c.closed {
-			c.closed = true
-			if !c.sendClosed {
-				close(c.send)
-				c.sendClosed = true
-			}
-			if c.ws != nil {
-				c.ws.Close() // Safe close, no direct WriteMessage
-			}
+		if c.ws != nil {
+			c.ws.Close() // Safe close, no direct WriteMessage
 		}
 	})
 }
 
+// closeWithReason sends the client a close frame explaining why it is being
+// disconnected. The hub still has to unregister and close the connection.
+func (c *Connection) closeWithReason(reason string) {
+	if c.ws == nil {
+		return
+	}
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	if err := c.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+		log.Printf("Failed to send close frame to user %s: %v", c.userID, err)
+	}
+}
+
+func (c *Connection) isClosed() bool {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	return c.closed
+}
+
+// trySend queues data without blocking. It reports false if the send
+// buffer is full or the connection has already been closed.
+func (c *Connection) trySend(data []byte) bool {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	if c.sendClosed {
+		return false
+	}
+	select {
+	case c.send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Connection) participant() Participant {
+	return Participant{
+		UserID:   c.userID,
+		UserName: c.userName,
+		JoinedAt: c.joinedAt,
+	}
+}
+
 func (c *Connection) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -511,6 +1130,7 @@ func (c *Connection) readPump() {
 		if r := recover(); r != nil {
 			log.Printf("Recovered in readPump: %v", r)
 		}
+		c.hub.unregister <- c
 		c.safeClose()
 	}()
 
@@ -539,11 +1159,26 @@ func (c *Connection) readPump() {
 			continue
 		}
 
-		// Set user info from the message
-		c.userID = msg.UserID
-		c.userName = msg.UserName
-		c.userEmail = msg.UserEmail
-		c.meetingID = msg.MeetingID
+		// Reject frames that claim to come from someone else or another meeting
+		if (msg.UserID != "" && msg.UserID != c.userID) || (msg.MeetingID != "" && normalizeMeetingID(msg.MeetingID) != c.meetingID) {
+			log.Printf("Rejected message from user %s in meeting %s claiming user %q meeting %q",
+				c.userID, c.meetingID, msg.UserID, msg.MeetingID)
+			c.sendError("Message identity does not match the authenticated connection")
+			continue
+		}
+
+		// Stamp the authenticated identity on everything relayed onwards
+		msg.UserID = c.userID
+		msg.UserName = c.userName
+		msg.UserEmail = c.userEmail
+		msg.MeetingID = c.meetingID
+		msg.Token = ""
+
+		// Until a host admits them, waiting users can only keep the socket alive
+		if c.inLobby.Load() && msg.Type != "auth" && msg.Type != "ping" {
+			c.sendError("Waiting for the host to admit you")
+			continue
+		}
 
 		switch msg.Type {
 		case "auth":
@@ -552,25 +1187,50 @@ func (c *Connection) readPump() {
 			c.handlePing()
 		case "chat":
 			c.handleChatMessage(msg)
+		case "chat-edit", "chat-delete":
+			c.handleChatCommand(msg)
+		case "chat-react":
+			c.handleChatReaction(msg)
+		case "chat-reply":
+			c.handleChatReply(msg)
+		case "chat-read":
+			c.handleChatRead(msg)
+		case "typing-start", "typing-stop":
+			c.handleTypingMessage(msg)
+		case "poll-create", "poll-vote", "poll-close":
+			c.handlePollCommand(msg)
+		case "question-ask", "question-upvote", "question-answer", "question-dismiss":
+			c.handleQuestionCommand(msg)
 		case "signaling":
 			c.handleSignaling(msg)
+		case "start-recording", "stop-recording":
+			c.handleRecording(msg)
+		case "mute-participant", "remove-participant", "unban-participant", "lock-meeting", "unlock-meeting", "private-chat":
+			c.handleModeration(msg)
+		case "lobby-admit", "lobby-deny", "waiting-room":
+			c.handleLobbyCommand(msg)
+		case "end-meeting":
+			c.handleEndMeeting()
 		default:
 			log.Printf("Unknown message type: %s", msg.Type)
 		}
 	}
 }
 
+// handleAuth acknowledges an auth message on an already authenticated
+// connection. The identity was fixed at handshake and is never changed here.
 func (c *Connection) handleAuth(msg WebSocketMessage) {
-	c.mutex.Lock()
-	c.userName = msg.UserName
-	c.userEmail = msg.UserEmail
-	c.mutex.Unlock()
-	
 	log.Printf("User %s authenticated in meeting %s", c.userID, c.meetingID)
-	
-	// Send confirmation
+	c.sendAuthSuccess()
+}
+
+func (c *Connection) sendAuthSuccess() {
 	response := WebSocketMessage{
 		Type:      "auth-success",
+		UserID:    c.userID,
+		UserName:  c.userName,
+		UserEmail: c.userEmail,
+		MeetingID: c.meetingID,
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 	c.sendMessage(response)
@@ -590,14 +1250,23 @@ func (c *Connection) handleChatMessage(msg WebSocketMessage) {
 		return
 	}
 
+	if msg.RecipientID != "" {
+		if err := c.sendPrivateChat(msg.RecipientID, strings.TrimSpace(messageContent)); err != nil {
+			log.Printf("Failed to send private message from user %s: %v", c.userID, err)
+			c.sendError(chatErrorMessage(err))
+		}
+		return
+	}
+
 	// Save message to database
 	chatMsg := ChatMessage{
-		MeetingID: c.meetingID,
-		UserID:    c.userID,
-		UserName:  c.userName,
-		UserEmail: c.userEmail,
-		Message:   strings.TrimSpace(messageContent),
-		Timestamp: time.Now(),
+		MeetingID:  c.meetingID,
+		UserID:     c.userID,
+		UserName:   c.userName,
+		UserEmail:  c.userEmail,
+		Message:    strings.TrimSpace(messageContent),
+		Timestamp:  time.Now(),
+		Visibility: chatVisibilityEveryone,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -632,7 +1301,7 @@ func (c *Connection) handleChatMessage(msg WebSocketMessage) {
 	}
 
 	// Broadcast to all users in the meeting
-	hub.broadcast <- &BroadcastMessage{
+	c.hub.broadcast <- &BroadcastMessage{
 		MeetingID:     c.meetingID,
 		Message:       broadcastData,
 		ExcludeUserID: c.userID,
@@ -641,8 +1310,21 @@ func (c *Connection) handleChatMessage(msg WebSocketMessage) {
 }
 
 func (c *Connection) handleSignaling(msg WebSocketMessage) {
-	// Broadcast signaling message to all users in the meeting
-	c.broadcastToMeeting(msg)
+	if c.mediaMode == mediaModeSFU {
+		c.handleSFUSignaling(msg)
+		return
+	}
+
+	// Offers, answers and ICE candidates are only meaningful to one peer
+	if msg.TargetUserID == "" {
+		c.sendError("Signaling message requires targetUserId")
+		return
+	}
+	if msg.TargetUserID == c.userID {
+		c.sendError("Cannot send signaling to yourself")
+		return
+	}
+	c.sendToUser(msg.TargetUserID, msg)
 }
 
 func (c *Connection) sendMessage(msg WebSocketMessage) {
@@ -652,13 +1334,20 @@ func (c *Connection) sendMessage(msg WebSocketMessage) {
 		return
 	}
 
-	select {
-	case c.send <- data:
-	default:
+	if !c.trySend(data) {
 		log.Printf("Send buffer full for user %s", c.userID)
 	}
 }
 
+func (c *Connection) sendError(message string) {
+	response := WebSocketMessage{
+		Type:      "error",
+		Data:      message,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	c.sendMessage(response)
+}
+
 func (c *Connection) broadcastToMeeting(msg WebSocketMessage) {
 	data, err := json.Marshal(msg)
 	if err != nil {
@@ -674,12 +1363,50 @@ func (c *Connection) broadcastToMeeting(msg WebSocketMessage) {
 	}
 
 	select {
-	case hub.broadcast <- broadcastMsg:
+	case c.hub.broadcast <- broadcastMsg:
 	default:
 		log.Printf("Broadcast buffer full")
 	}
 }
 
+func (c *Connection) sendToUser(targetUserID string, msg WebSocketMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal direct message: %v", err)
+		return
+	}
+
+	directMsg := &DirectMessage{
+		MeetingID:    c.meetingID,
+		TargetUserID: targetUserID,
+		Message:      data,
+		MessageType:  msg.Type,
+		Sender:       c,
+	}
+
+	select {
+	case c.hub.direct <- directMsg:
+	default:
+		log.Printf("Direct message buffer full")
+	}
+}
+
+// broadcastEvent sends a server generated event to everyone in a meeting.
+// It must not be called from the hub goroutine.
+func broadcastEvent(meetingID string, msg WebSocketMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", msg.Type, err)
+		return
+	}
+
+	hub.broadcast <- &BroadcastMessage{
+		MeetingID:   meetingID,
+		Message:     data,
+		MessageType: msg.Type,
+	}
+}
+
 // Auth Handlers (keeping existing ones)
 func registerHandler(c *gin.Context) {
 	var user User
@@ -707,7 +1434,7 @@ func registerHandler(c *gin.Context) {
 	}
 
 	user.ID = result.InsertedID.(primitive.ObjectID)
-	
+
 	// Generate JWT token
 	token, err := generateJWT(user.ID.Hex(), user.Email, user.Name)
 	if err != nil {
@@ -766,9 +1493,13 @@ func loginHandler(c *gin.Context) {
 // Meeting Handlers
 func createMeetingHandler(c *gin.Context) {
 	claims := c.MustGet("claims").(*Claims)
-	
+
 	var meetingData struct {
-		Title string `json:"title"`
+		Title              string `json:"title"`
+		MediaMode          string `json:"mediaMode"`
+		WaitingRoomEnabled bool   `json:"waitingRoomEnabled"`
+		Passcode           string `json:"passcode"`
+		ScheduleInput
 	}
 
 	if err := c.ShouldBindJSON(&meetingData); err != nil {
@@ -776,28 +1507,51 @@ func createMeetingHandler(c *gin.Context) {
 		return
 	}
 
-	// Generate meeting ID
-	meetingID := generateMeetingID()
-	
+	switch meetingData.MediaMode {
+	case "":
+		meetingData.MediaMode = mediaModeMesh
+	case mediaModeMesh, mediaModeSFU:
+	default:
+		c.JSON(400, gin.H{"error": "mediaMode must be mesh or sfu"})
+		return
+	}
+
+	var passcodeHash string
+	if meetingData.Passcode != "" {
+		var err error
+		passcodeHash, err = hashPasscode(meetingData.Passcode)
+		if err == errPasscodeLength {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to set passcode"})
+			return
+		}
+	}
+
 	userID, _ := primitive.ObjectIDFromHex(claims.UserID)
 	meeting := Meeting{
-		MeetingID:    meetingID,
 		Title:        meetingData.Title,
 		CreatedBy:    userID,
-		Participants: []string{claims.Name},
+		Participants: []string{claims.UserID},
 		CreatedAt:    time.Now(),
-		IsActive:     true,
+		Status:       meetingStatusScheduled,
+		MediaMode:    meetingData.MediaMode,
+
+		WaitingRoomEnabled: meetingData.WaitingRoomEnabled,
+		PasscodeHash:       passcodeHash,
+	}
+	if err := applySchedule(&meeting, meetingData.ScheduleInput); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
 	}
 
-	collection := db.Collection("meetings")
-	result, err := collection.InsertOne(context.Background(), meeting)
-	if err != nil {
+	// Pick a meeting ID that is not already taken
+	if err := insertMeeting(&meeting); err != nil {
 		c.JSON(500, gin.H{"error": "Failed to create meeting"})
 		return
 	}
 
-	meeting.ID = result.InsertedID.(primitive.ObjectID)
-
 	c.JSON(201, gin.H{
 		"message": "Meeting created successfully",
 		"meeting": meeting,
@@ -806,9 +1560,11 @@ func createMeetingHandler(c *gin.Context) {
 
 func joinMeetingHandler(c *gin.Context) {
 	claims := c.MustGet("claims").(*Claims)
-	
+
 	var joinData struct {
 		MeetingID string `json:"meetingId"`
+		Passcode  string `json:"passcode"`
+		Invite    string `json:"invite"`
 	}
 
 	if err := c.ShouldBindJSON(&joinData); err != nil {
@@ -816,6 +1572,7 @@ func joinMeetingHandler(c *gin.Context) {
 		return
 	}
 
+	joinData.MeetingID = normalizeMeetingID(joinData.MeetingID)
 	if joinData.MeetingID == "" {
 		c.JSON(400, gin.H{"error": "Meeting ID is required"})
 		return
@@ -834,9 +1591,23 @@ func joinMeetingHandler(c *gin.Context) {
 		return
 	}
 
-	// Check if meeting is active
-	if !meeting.IsActive {
-		c.JSON(400, gin.H{"error": "Meeting is no longer active"})
+	// Check the meeting has not ended or been cancelled
+	if err := meeting.closedError(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := admissionError(&meeting, claims.UserID); err != nil {
+		c.JSON(403, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkAccess(&meeting, claims.UserID, joinData.Passcode, joinData.Invite); err != nil {
+		if status := accessErrorStatus(err); status != 500 {
+			c.JSON(status, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(500, gin.H{"error": "Failed to check meeting access"})
+		}
 		return
 	}
 
@@ -849,7 +1620,9 @@ func joinMeetingHandler(c *gin.Context) {
 		}
 	}
 
-	if !participantExists {
+	// People sent to the waiting room become participants once they are
+	// let into the meeting, see recordParticipant
+	if !participantExists && !needsLobby(&meeting, claims.UserID) {
 		meeting.Participants = append(meeting.Participants, claims.UserID)
 		_, err = collection.UpdateOne(
 			context.Background(),
@@ -863,60 +1636,21 @@ func joinMeetingHandler(c *gin.Context) {
 	}
 
 	c.JSON(200, gin.H{
-		"message": "Joined meeting successfully",
-		"meeting": meeting,
+		"message":     "Joined meeting successfully",
+		"meeting":     meeting,
+		"waitingRoom": needsLobby(&meeting, claims.UserID),
 	})
 }
 
 func getMeetingHandler(c *gin.Context) {
-	meetingID := c.Param("id")
-
-	collection := db.Collection("meetings")
-	var meeting Meeting
-	err := collection.FindOne(context.Background(), bson.M{"meeting_id": meetingID}).Decode(&meeting)
-	if err != nil {
-		c.JSON(404, gin.H{"error": "Meeting not found"})
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleInvitee)
+	if !ok {
 		return
 	}
 
 	c.JSON(200, gin.H{"meeting": meeting})
 }
 
-func getChatMessagesHandler(c *gin.Context) {
-	meetingID := c.Param("meetingId")
-	
-	if meetingID == "" {
-		c.JSON(400, gin.H{"error": "Meeting ID is required"})
-		return
-	}
-
-	collection := db.Collection("chat_messages")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	
-	cursor, err := collection.Find(
-		ctx,
-		bson.M{"meeting_id": meetingID},
-		options.Find().SetSort(bson.M{"timestamp": 1}),
-	)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch messages"})
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var messages []ChatMessage
-	if err := cursor.All(ctx, &messages); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to decode messages"})
-		return
-	}
-
-	c.JSON(200, gin.H{
-		"messages": messages,
-		"count":    len(messages),
-	})
-}
-
 // Middleware
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -927,21 +1661,13 @@ func authMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
-			tokenString = tokenString[7:]
-		}
-
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := parseToken(tokenString)
+		if err != nil {
 			c.JSON(401, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		claims := token.Claims.(*Claims)
 		c.Set("claims", claims)
 		c.Next()
 	}
@@ -963,11 +1689,52 @@ func generateJWT(userID, email, name string) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
-func generateMeetingID() string {
-	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
-	result := make([]byte, 10)
-	for i := range result {
-		result[i] = chars[time.Now().UnixNano()%int64(len(chars))]
+// parseToken validates a JWT, with or without a "Bearer " prefix, and returns its claims
+func parseToken(tokenString string) (*Claims, error) {
+	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims := token.Claims.(*Claims)
+	if claims.UserID == "" {
+		return nil, errors.New("token has no user id")
+	}
+	return claims, nil
+}
+
+// isMeetingHost reports whether userID is the meeting's owner or a co-host
+func isMeetingHost(meeting *Meeting, userID string) bool {
+	return meeting.CreatedBy.Hex() == userID || containsString(meeting.CoHosts, userID)
+}
+
+func loadMeeting(meetingID string) (*Meeting, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var meeting Meeting
+	err := db.Collection("meetings").FindOne(ctx, bson.M{"meeting_id": meetingID}).Decode(&meeting)
+	if err != nil {
+		return nil, err
 	}
-	return string(result)
-}
\ No newline at end of file
+	return &meeting, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
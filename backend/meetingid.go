@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"log"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	meetingIDAlphabet = "abcdefghijklmnopqrstuvwxyz"
+	meetingIDAttempts = 5 // inserts tried before giving up on collisions
+	maxPersonalRooms  = 3
+)
+
+// Readable IDs are grouped like abc-defg-hij
+var meetingIDGroups = []int{3, 4, 3}
+
+// Vanity IDs are 4-40 lowercase letters, digits and single hyphens
+var vanityIDPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+var (
+	errMeetingIDTaken  = errors.New("that room ID is already taken")
+	errInvalidVanityID = errors.New("room ID must be 4-40 lowercase letters, digits and hyphens")
+	errTooManyRooms    = errors.New("you have reserved the maximum number of personal rooms")
+	errNoFreeMeetingID = errors.New("could not find a free meeting ID")
+)
+
+// generateMeetingID returns a random ID such as "kfz-qpwm-tra". It has
+// 26^10 possibilities, so collisions are rare but still checked on insert.
+func generateMeetingID() (string, error) {
+	var builder strings.Builder
+	limit := big.NewInt(int64(len(meetingIDAlphabet)))
+	for i, size := range meetingIDGroups {
+		if i > 0 {
+			builder.WriteByte('-')
+		}
+		for j := 0; j < size; j++ {
+			n, err := rand.Int(rand.Reader, limit)
+			if err != nil {
+				return "", err
+			}
+			builder.WriteByte(meetingIDAlphabet[n.Int64()])
+		}
+	}
+	return builder.String(), nil
+}
+
+// normalizeMeetingID accepts IDs typed with stray spaces or capitals
+func normalizeMeetingID(meetingID string) string {
+	return strings.ToLower(strings.TrimSpace(meetingID))
+}
+
+// ensureMeetingIndexes creates the unique index that insertMeeting relies
+// on to detect ID collisions, first renaming any duplicates it would trip on
+func ensureMeetingIndexes(ctx context.Context) error {
+	if err := dedupeMeetingIDs(ctx); err != nil {
+		return err
+	}
+	_, err := db.Collection("meetings").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "meeting_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// dedupeMeetingIDs gives a fresh ID to every meeting that shares its
+// meeting_id with an older one. The old time-seeded generator could hand out
+// the same ID twice, and only one of the meetings was ever reachable by it.
+func dedupeMeetingIDs(ctx context.Context) error {
+	cursor, err := db.Collection("meetings").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$meeting_id", "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var duplicates []struct {
+		MeetingID string               `bson:"_id"`
+		IDs       []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return err
+	}
+
+	for _, duplicate := range duplicates {
+		// ObjectIDs start with their creation time, so the oldest keeps the ID
+		sort.Slice(duplicate.IDs, func(i, j int) bool {
+			return bytes.Compare(duplicate.IDs[i][:], duplicate.IDs[j][:]) < 0
+		})
+		for _, id := range duplicate.IDs[1:] {
+			meetingID, err := generateMeetingID()
+			if err != nil {
+				return err
+			}
+			_, err = db.Collection("meetings").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"meeting_id": meetingID}})
+			if err != nil {
+				return err
+			}
+			log.Printf("Meeting %s shared ID %s with an older meeting, renamed it to %s", id.Hex(), duplicate.MeetingID, meetingID)
+		}
+	}
+	return nil
+}
+
+// insertMeeting stores a meeting under a fresh random ID, drawing another
+// one if the unique index reports a collision
+func insertMeeting(meeting *Meeting) error {
+	for attempt := 0; attempt < meetingIDAttempts; attempt++ {
+		meetingID, err := generateMeetingID()
+		if err != nil {
+			return err
+		}
+		meeting.MeetingID = meetingID
+
+		err = insertMeetingWithID(meeting)
+		if err != errMeetingIDTaken {
+			return err
+		}
+	}
+	return errNoFreeMeetingID
+}
+
+// insertMeetingWithID stores a meeting under the ID it already carries
+func insertMeetingWithID(meeting *Meeting) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("meetings").InsertOne(ctx, meeting)
+	if mongo.IsDuplicateKeyError(err) {
+		return errMeetingIDTaken
+	}
+	if err != nil {
+		return err
+	}
+	meeting.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func validVanityID(roomID string) bool {
+	return len(roomID) >= 4 && len(roomID) <= 40 && vanityIDPattern.MatchString(roomID)
+}
+
+// reserveRoomHandler reserves a vanity ID as the caller's personal room, a
+// meeting that stays open under the same link
+func reserveRoomHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	var roomData struct {
+		RoomID    string `json:"roomId"`
+		Title     string `json:"title"`
+		MediaMode string `json:"mediaMode"`
+	}
+
+	if err := c.ShouldBindJSON(&roomData); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	roomID := normalizeMeetingID(roomData.RoomID)
+	if !validVanityID(roomID) {
+		c.JSON(400, gin.H{"error": errInvalidVanityID.Error()})
+		return
+	}
+
+	switch roomData.MediaMode {
+	case "":
+		roomData.MediaMode = mediaModeMesh
+	case mediaModeMesh, mediaModeSFU:
+	default:
+		c.JSON(400, gin.H{"error": "mediaMode must be mesh or sfu"})
+		return
+	}
+
+	userID, _ := primitive.ObjectIDFromHex(claims.UserID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count, err := db.Collection("meetings").CountDocuments(ctx, bson.M{"created_by": userID, "personal": true})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to reserve room"})
+		return
+	}
+	if count >= maxPersonalRooms {
+		c.JSON(409, gin.H{"error": errTooManyRooms.Error()})
+		return
+	}
+
+	meeting := Meeting{
+		MeetingID:    roomID,
+		Title:        roomData.Title,
+		CreatedBy:    userID,
+		Participants: []string{claims.UserID},
+		CreatedAt:    time.Now(),
+		Status:       meetingStatusScheduled,
+		MediaMode:    roomData.MediaMode,
+		Personal:     true,
+	}
+
+	err = insertMeetingWithID(&meeting)
+	switch err {
+	case nil:
+	case errMeetingIDTaken:
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(500, gin.H{"error": "Failed to reserve room"})
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"message": "Room reserved successfully",
+		"meeting": meeting,
+	})
+}
+
+// listRoomsHandler lists the caller's personal rooms
+func listRoomsHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+	userID, _ := primitive.ObjectIDFromHex(claims.UserID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.Collection("meetings").Find(
+		ctx,
+		bson.M{"created_by": userID, "personal": true},
+		options.Find().SetSort(bson.M{"created_at": 1}),
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch rooms"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	rooms := []Meeting{}
+	if err = cursor.All(ctx, &rooms); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to decode rooms"})
+		return
+	}
+
+	c.JSON(200, gin.H{"rooms": rooms})
+}
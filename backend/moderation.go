@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const leaveReasonRemoved = "removed"
+
+var (
+	errNotHost           = errors.New("only the host can do that")
+	errNotOwner          = errors.New("only the meeting owner can do that")
+	errInvalidTarget     = errors.New("invalid target participant")
+	errInvalidMuteKind   = errors.New("kind must be audio or video")
+	errBannedFromMeeting = errors.New("you have been removed from this meeting")
+	errMeetingLocked     = errors.New("meeting is locked")
+)
+
+// KickRequest asks the hub to disconnect a user from a meeting, on whichever
+// node they are connected to
+type KickRequest struct {
+	MeetingID string
+	UserID    string
+	Reason    string
+}
+
+// HostChange tells the hubs that a user gained or lost co-host rights, so
+// their connection gets or stops getting host-only updates on every node
+type HostChange struct {
+	MeetingID string
+	UserID    string
+	Host      bool
+}
+
+// admissionError reports why userID may not enter the meeting, or nil if they may
+func admissionError(meeting *Meeting, userID string) error {
+	if containsString(meeting.BannedUsers, userID) {
+		return errBannedFromMeeting
+	}
+	// A locked meeting still lets hosts and people who already joined back in
+	if meeting.Locked && !isMeetingHost(meeting, userID) && !containsString(meeting.Participants, userID) {
+		return errMeetingLocked
+	}
+	return nil
+}
+
+// muteParticipant asks a participant's client to turn off its audio or
+// video. The request goes to the whole room so every client can update.
+func muteParticipant(meeting *Meeting, actorID, targetID, kind string) error {
+	if !isMeetingHost(meeting, actorID) {
+		return errNotHost
+	}
+	if targetID == "" {
+		return errInvalidTarget
+	}
+	if kind != "audio" && kind != "video" {
+		return errInvalidMuteKind
+	}
+
+	log.Printf("User %s muted %s of user %s in meeting %s", actorID, kind, targetID, meeting.MeetingID)
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:         "mute-request",
+		Data:         map[string]string{"kind": kind},
+		UserID:       actorID,
+		MeetingID:    meeting.MeetingID,
+		TargetUserID: targetID,
+		Timestamp:    time.Now().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// removeParticipant disconnects a participant and bans them from the meeting
+func removeParticipant(meeting *Meeting, actorID, targetID string) error {
+	if !isMeetingHost(meeting, actorID) {
+		return errNotHost
+	}
+	if targetID == "" || targetID == actorID || targetID == meeting.CreatedBy.Hex() {
+		return errInvalidTarget
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{"$addToSet": bson.M{"banned_users": targetID}},
+	)
+	if err != nil {
+		return err
+	}
+	if !containsString(meeting.BannedUsers, targetID) {
+		meeting.BannedUsers = append(meeting.BannedUsers, targetID)
+	}
+
+	log.Printf("User %s removed user %s from meeting %s", actorID, targetID, meeting.MeetingID)
+
+	hub.kick <- &KickRequest{MeetingID: meeting.MeetingID, UserID: targetID, Reason: leaveReasonRemoved}
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:         "participant-removed",
+		UserID:       actorID,
+		MeetingID:    meeting.MeetingID,
+		TargetUserID: targetID,
+		Timestamp:    time.Now().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// unbanParticipant lets a removed user back in. Bans outlast the sitting
+// they were made in, so this is the only way to lift one.
+func unbanParticipant(meeting *Meeting, actorID, targetID string) error {
+	if !isMeetingHost(meeting, actorID) {
+		return errNotHost
+	}
+	if targetID == "" {
+		return errInvalidTarget
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var updated Meeting
+	err := db.Collection("meetings").FindOneAndUpdate(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{"$pull": bson.M{"banned_users": targetID}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		return err
+	}
+	*meeting = updated
+
+	log.Printf("User %s unbanned user %s from meeting %s", actorID, targetID, meeting.MeetingID)
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:         "participant-unbanned",
+		UserID:       actorID,
+		MeetingID:    meeting.MeetingID,
+		TargetUserID: targetID,
+		Timestamp:    time.Now().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// setMeetingLocked stops or resumes admitting new joiners
+func setMeetingLocked(meeting *Meeting, actorID string, locked bool) error {
+	if !isMeetingHost(meeting, actorID) {
+		return errNotHost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{"$set": bson.M{"locked": locked}},
+	)
+	if err != nil {
+		return err
+	}
+	meeting.Locked = locked
+
+	eventType := "meeting-unlocked"
+	if locked {
+		eventType = "meeting-locked"
+	}
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:      eventType,
+		UserID:    actorID,
+		MeetingID: meeting.MeetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+	return nil
+}
+
+// setCoHost grants or revokes host powers. Only the owner can do this.
+func setCoHost(meeting *Meeting, actorID, targetID string, coHost bool) error {
+	if meeting.CreatedBy.Hex() != actorID {
+		return errNotOwner
+	}
+	if targetID == "" || targetID == actorID {
+		return errInvalidTarget
+	}
+
+	operator := "$pull"
+	if coHost {
+		operator = "$addToSet"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var updated Meeting
+	err := db.Collection("meetings").FindOneAndUpdate(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{operator: bson.M{"co_hosts": targetID}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		return err
+	}
+	*meeting = updated
+	hub.hostChanges <- &HostChange{MeetingID: meeting.MeetingID, UserID: targetID, Host: isMeetingHost(meeting, targetID)}
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:         "cohosts-updated",
+		Data:         meeting.CoHosts,
+		UserID:       actorID,
+		MeetingID:    meeting.MeetingID,
+		TargetUserID: targetID,
+		Timestamp:    time.Now().Format(time.RFC3339),
+	})
+	return nil
+}
+
+func (h *Hub) handleKick(req *KickRequest) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.kickLocked(req.MeetingID, req.UserID, req.Reason)
+
+	// The user may be connected to another node
+	if _, remote := h.remoteParticipants[req.MeetingID][req.UserID]; remote {
+		h.publish(&BackplaneEnvelope{
+			Kind:         envelopeKick,
+			MeetingID:    req.MeetingID,
+			TargetUserID: req.UserID,
+			Reason:       req.Reason,
+		})
+	}
+}
+
+func (h *Hub) handleHostChange(change *HostChange) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.applyHostChangeLocked(change.MeetingID, change.UserID, change.Host)
+	h.publish(&BackplaneEnvelope{
+		Kind:         envelopeHostChange,
+		MeetingID:    change.MeetingID,
+		TargetUserID: change.UserID,
+		Host:         change.Host,
+	})
+}
+
+// applyHostChangeLocked updates a local user's host rights. A new co-host
+// is sent the lobby straight away. Caller must hold h.mutex.
+func (h *Hub) applyHostChangeLocked(meetingID, userID string, host bool) {
+	conn, exists := h.meetings[meetingID][userID]
+	if !exists || conn.isHost == host {
+		return
+	}
+	conn.isHost = host
+	if host {
+		conn.sendMessage(WebSocketMessage{
+			Type:      "lobby-update",
+			Data:      h.lobbyLocked(meetingID),
+			MeetingID: meetingID,
+			Timestamp: time.Now().Format(time.RFC3339),
+		})
+	}
+}
+
+// kickLocked closes a local user's connection, telling them why first.
+// Caller must hold h.mutex.
+func (h *Hub) kickLocked(meetingID, userID, reason string) {
+	conn, exists := h.meetings[meetingID][userID]
+	if !exists || !h.forgetLocked(conn) {
+		return
+	}
+	h.announceLeaveLocked(conn, reason)
+	go conn.closeAfter(nil, reason)
+}
+
+func (c *Connection) handleModeration(msg WebSocketMessage) {
+	meeting, err := loadMeeting(c.meetingID)
+	if err != nil {
+		c.sendError("Meeting not found")
+		return
+	}
+
+	switch msg.Type {
+	case "mute-participant":
+		var data struct {
+			Kind string `json:"kind"`
+		}
+		if err = decodeData(msg.Data, &data); err == nil {
+			err = muteParticipant(meeting, c.userID, msg.TargetUserID, data.Kind)
+		}
+	case "remove-participant":
+		err = removeParticipant(meeting, c.userID, msg.TargetUserID)
+	case "unban-participant":
+		err = unbanParticipant(meeting, c.userID, msg.TargetUserID)
+	case "lock-meeting":
+		err = setMeetingLocked(meeting, c.userID, true)
+	case "unlock-meeting":
+		err = setMeetingLocked(meeting, c.userID, false)
+	case "private-chat":
+		var data struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err = decodeData(msg.Data, &data); err == nil {
+			err = setPrivateChat(meeting, c.userID, data.Enabled)
+		}
+	}
+	if err != nil {
+		c.sendError(err.Error())
+	}
+}
+
+var moderationMessages = map[string]string{
+	"mute":         "Mute requested",
+	"remove":       "Participant removed",
+	"unban":        "Participant unbanned",
+	"lock":         "Meeting lock updated",
+	"cohosts":      "Co-hosts updated",
+	"waiting-room": "Waiting room updated",
+	"private-chat": "Private chat updated",
+}
+
+// moderationHandler serves the REST versions of the host commands:
+// POST /meeting/:id/mute, /remove, /unban, /lock, /cohosts, /waiting-room and
+// /private-chat
+func moderationHandler(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*Claims)
+
+		var moderationData struct {
+			UserID  string `json:"userId"`
+			Kind    string `json:"kind"`
+			Locked  *bool  `json:"locked"`
+			Enabled *bool  `json:"enabled"`
+			Action  string `json:"action"`
+		}
+
+		if err := c.ShouldBindJSON(&moderationData); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+		if !ok {
+			return
+		}
+
+		var err error
+		switch action {
+		case "mute":
+			err = muteParticipant(meeting, claims.UserID, moderationData.UserID, moderationData.Kind)
+		case "remove":
+			err = removeParticipant(meeting, claims.UserID, moderationData.UserID)
+		case "unban":
+			err = unbanParticipant(meeting, claims.UserID, moderationData.UserID)
+		case "lock":
+			if moderationData.Locked == nil {
+				c.JSON(400, gin.H{"error": "locked is required"})
+				return
+			}
+			err = setMeetingLocked(meeting, claims.UserID, *moderationData.Locked)
+		case "waiting-room":
+			if moderationData.Enabled == nil {
+				c.JSON(400, gin.H{"error": "enabled is required"})
+				return
+			}
+			err = setWaitingRoom(meeting, claims.UserID, *moderationData.Enabled)
+		case "private-chat":
+			if moderationData.Enabled == nil {
+				c.JSON(400, gin.H{"error": "enabled is required"})
+				return
+			}
+			err = setPrivateChat(meeting, claims.UserID, *moderationData.Enabled)
+		case "cohosts":
+			if moderationData.Action != "add" && moderationData.Action != "remove" {
+				c.JSON(400, gin.H{"error": "action must be add or remove"})
+				return
+			}
+			err = setCoHost(meeting, claims.UserID, moderationData.UserID, moderationData.Action == "add")
+		}
+
+		switch err {
+		case nil:
+		case errNotHost, errNotOwner:
+			c.JSON(403, gin.H{"error": err.Error()})
+			return
+		case errInvalidTarget, errInvalidMuteKind:
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		default:
+			c.JSON(500, gin.H{"error": "Failed to apply moderation action"})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"message": moderationMessages[action],
+			"meeting": meeting,
+		})
+	}
+}
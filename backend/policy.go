@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// meetingRole is what a user is to a meeting. Roles are ordered, so a host
+// can do anything a participant can and a participant anything an invitee can.
+type meetingRole int
+
+const (
+	roleNone meetingRole = iota
+	roleInvitee
+	roleParticipant
+	roleHost
+)
+
+func (r meetingRole) String() string {
+	switch r {
+	case roleInvitee:
+		return "invitee"
+	case roleParticipant:
+		return "participant"
+	case roleHost:
+		return "host"
+	}
+	return "none"
+}
+
+// deniedMessage is the error shown to a caller who lacks the role
+func (r meetingRole) deniedMessage() string {
+	switch r {
+	case roleHost:
+		return errNotHost.Error()
+	case roleParticipant:
+		return "You are not a participant in this meeting"
+	}
+	return "You are not invited to this meeting"
+}
+
+// AccessDenial records a request that authorizeMeeting turned away
+type AccessDenial struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	MeetingID string             `bson:"meeting_id" json:"meeting_id"`
+	UserID    string             `bson:"user_id" json:"user_id"`
+	Email     string             `bson:"email" json:"email"`
+	Method    string             `bson:"method" json:"method"`
+	Path      string             `bson:"path" json:"path"`
+	Required  string             `bson:"required" json:"required"`
+	Role      string             `bson:"role" json:"role"`
+	ClientIP  string             `bson:"client_ip" json:"client_ip"`
+	At        time.Time          `bson:"at" json:"at"`
+}
+
+func ensureAuditIndexes(ctx context.Context) error {
+	_, err := db.Collection("access_denials").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "meeting_id", Value: 1}, {Key: "at", Value: -1}},
+	})
+	return err
+}
+
+// meetingRoleOf works out the strongest role claims' user holds in a
+// meeting. Banned users hold none, whatever else they were.
+func meetingRoleOf(meeting *Meeting, claims *Claims) meetingRole {
+	switch {
+	case isMeetingHost(meeting, claims.UserID):
+		return roleHost
+	case containsString(meeting.BannedUsers, claims.UserID):
+		return roleNone
+	case containsString(meeting.Participants, claims.UserID),
+		containsString(meeting.AdmittedUsers, claims.UserID):
+		return roleParticipant
+	case claims.Email != "" && containsString(meeting.Invitees, strings.ToLower(claims.Email)):
+		return roleInvitee
+	}
+	return roleNone
+}
+
+// meetingRoleFilter matches the meetings in which claims' user holds at
+// least the required role, by the same rules as meetingRoleOf
+func meetingRoleFilter(claims *Claims, required meetingRole) bson.M {
+	userID, _ := primitive.ObjectIDFromHex(claims.UserID)
+	hosts := []bson.M{{"created_by": userID}, {"co_hosts": claims.UserID}}
+	if required >= roleHost {
+		return bson.M{"$or": hosts}
+	}
+
+	members := []bson.M{{"participants": claims.UserID}, {"admitted_users": claims.UserID}}
+	if required <= roleInvitee && claims.Email != "" {
+		members = append(members, bson.M{"invitees": strings.ToLower(claims.Email)})
+	}
+	return bson.M{"$or": append(hosts, bson.M{
+		"banned_users": bson.M{"$ne": claims.UserID},
+		"$or":          members,
+	})}
+}
+
+// authorizeMeeting loads a meeting and checks the caller holds at least the
+// required role in it, responding with an error and recording the denial if
+// not. Every meeting-scoped endpoint goes through it.
+func authorizeMeeting(c *gin.Context, meetingID string, required meetingRole) (*Meeting, bool) {
+	claims := c.MustGet("claims").(*Claims)
+
+	meeting, err := loadMeeting(normalizeMeetingID(meetingID))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(404, gin.H{"error": "Meeting not found"})
+		} else {
+			c.JSON(500, gin.H{"error": "Failed to find meeting"})
+		}
+		return nil, false
+	}
+
+	if role := meetingRoleOf(meeting, claims); role < required {
+		go recordDenial(&AccessDenial{
+			MeetingID: meeting.MeetingID,
+			UserID:    claims.UserID,
+			Email:     claims.Email,
+			Method:    c.Request.Method,
+			Path:      c.FullPath(),
+			Required:  required.String(),
+			Role:      role.String(),
+			ClientIP:  c.ClientIP(),
+			At:        time.Now(),
+		})
+		c.JSON(403, gin.H{"error": required.deniedMessage()})
+		return nil, false
+	}
+	return meeting, true
+}
+
+func recordDenial(denial *AccessDenial) {
+	log.Printf("Denied %s %s on meeting %s to user %s (%s, needs %s)",
+		denial.Method, denial.Path, denial.MeetingID, denial.UserID, denial.Role, denial.Required)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := db.Collection("access_denials").InsertOne(ctx, denial); err != nil {
+		log.Printf("Failed to record access denial for meeting %s: %v", denial.MeetingID, err)
+	}
+}
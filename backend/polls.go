@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	minPollOptions        = 2
+	maxPollOptions        = 10
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 100
+)
+
+var (
+	errPollNotFound   = errors.New("poll not found")
+	errPollClosed     = errors.New("poll is closed")
+	errAlreadyVoted   = errors.New("you have already voted in this poll")
+	errInvalidPoll    = errors.New("a poll needs a question and 2 to 10 different options")
+	errInvalidChoice  = errors.New("choose one of the poll's options")
+	errInvalidChoices = errors.New("choose at least one of the poll's options, each once")
+)
+
+// Poll is a question a host puts to a meeting. Tallies has a count for each
+// option. Every vote is final.
+type Poll struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	MeetingID  string             `bson:"meeting_id" json:"meeting_id"`
+	Question   string             `bson:"question" json:"question"`
+	Options    []string           `bson:"options" json:"options"`
+	Multiple   bool               `bson:"multiple" json:"multiple"`
+	Anonymous  bool               `bson:"anonymous" json:"anonymous"`
+	CreatedBy  string             `bson:"created_by" json:"created_by"`
+	AuthorName string             `bson:"author_name" json:"author_name"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	Closed     bool               `bson:"closed" json:"closed"`
+	ClosedAt   *time.Time         `bson:"closed_at,omitempty" json:"closed_at,omitempty"`
+	Tallies    []int              `bson:"tallies" json:"tallies"`
+	VoteCount  int                `bson:"vote_count" json:"vote_count"`
+	// Voters stops anyone voting twice. Ballots, the options each voter
+	// chose, is only kept for polls that are not anonymous.
+	Voters  []string         `bson:"voters" json:"-"`
+	Ballots map[string][]int `bson:"ballots,omitempty" json:"ballots,omitempty"`
+}
+
+func ensurePollIndexes(ctx context.Context) error {
+	_, err := db.Collection("polls").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "meeting_id", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	return err
+}
+
+// voteError reports why userID may not vote in the poll, or nil if they may
+func (p *Poll) voteError(userID string) error {
+	if p.Closed {
+		return errPollClosed
+	}
+	if containsString(p.Voters, userID) {
+		return errAlreadyVoted
+	}
+	return nil
+}
+
+// validChoices reports whether choices picks options of the poll: exactly
+// one for a single-choice poll, one or more different ones otherwise
+func (p *Poll) validChoices(choices []int) error {
+	invalid := errInvalidChoice
+	if p.Multiple {
+		invalid = errInvalidChoices
+	}
+	if len(choices) == 0 || (!p.Multiple && len(choices) > 1) {
+		return invalid
+	}
+	seen := make(map[int]bool, len(choices))
+	for _, choice := range choices {
+		if choice < 0 || choice >= len(p.Options) || seen[choice] {
+			return invalid
+		}
+		seen[choice] = true
+	}
+	return nil
+}
+
+func loadPoll(ctx context.Context, meetingID string, pollID primitive.ObjectID) (*Poll, error) {
+	var poll Poll
+	err := db.Collection("polls").FindOne(ctx, bson.M{"_id": pollID, "meeting_id": meetingID}).Decode(&poll)
+	if err == mongo.ErrNoDocuments {
+		return nil, errPollNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &poll, nil
+}
+
+// broadcastPoll tells the meeting about a poll, carrying its current tallies
+func broadcastPoll(eventType string, poll *Poll, actorID string) {
+	broadcastEvent(poll.MeetingID, WebSocketMessage{
+		Type:      eventType,
+		Data:      poll,
+		UserID:    actorID,
+		MeetingID: poll.MeetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+		ID:        poll.ID.Hex(),
+	})
+}
+
+// createPoll opens a poll in a meeting. Only hosts can ask.
+func createPoll(meeting *Meeting, conn *Connection, question string, options []string, multiple, anonymous bool) (*Poll, error) {
+	if !isMeetingHost(meeting, conn.userID) {
+		return nil, errNotHost
+	}
+
+	question = strings.TrimSpace(question)
+	if question == "" || utf8.RuneCountInString(question) > maxPollQuestionLength {
+		return nil, errInvalidPoll
+	}
+	if len(options) < minPollOptions || len(options) > maxPollOptions {
+		return nil, errInvalidPoll
+	}
+	cleaned := make([]string, len(options))
+	for i, option := range options {
+		option = strings.TrimSpace(option)
+		if option == "" || utf8.RuneCountInString(option) > maxPollOptionLength || containsString(cleaned[:i], option) {
+			return nil, errInvalidPoll
+		}
+		cleaned[i] = option
+	}
+
+	poll := Poll{
+		MeetingID:  meeting.MeetingID,
+		Question:   question,
+		Options:    cleaned,
+		Multiple:   multiple,
+		Anonymous:  anonymous,
+		CreatedBy:  conn.userID,
+		AuthorName: conn.userName,
+		CreatedAt:  time.Now(),
+		Tallies:    make([]int, len(cleaned)),
+		Voters:     []string{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("polls").InsertOne(ctx, poll)
+	if err != nil {
+		return nil, err
+	}
+	poll.ID = result.InsertedID.(primitive.ObjectID)
+
+	log.Printf("User %s opened poll %s in meeting %s", conn.userID, poll.ID.Hex(), meeting.MeetingID)
+
+	broadcastPoll("poll-created", &poll, conn.userID)
+	return &poll, nil
+}
+
+// votePoll records a vote and sends everyone the new tallies
+func votePoll(meetingID, userID string, pollID primitive.ObjectID, choices []int) (*Poll, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	poll, err := loadPoll(ctx, meetingID, pollID)
+	if err != nil {
+		return nil, err
+	}
+	if err := poll.voteError(userID); err != nil {
+		return nil, err
+	}
+	if err := poll.validChoices(choices); err != nil {
+		return nil, err
+	}
+
+	tallies := bson.M{"vote_count": 1}
+	for _, choice := range choices {
+		tallies["tallies."+strconv.Itoa(choice)] = 1
+	}
+	update := bson.M{
+		"$inc":  tallies,
+		"$push": bson.M{"voters": userID},
+	}
+	if !poll.Anonymous {
+		update["$set"] = bson.M{"ballots." + userID: choices}
+	}
+
+	// Filtered on the voters so a vote sent twice at once only counts once
+	var updated Poll
+	err = db.Collection("polls").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": pollID, "meeting_id": meetingID, "closed": false, "voters": bson.M{"$ne": userID}},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		// Closed or voted in since it was loaded
+		if poll, err = loadPoll(ctx, meetingID, pollID); err != nil {
+			return nil, err
+		}
+		if err := poll.voteError(userID); err != nil {
+			return nil, err
+		}
+		return nil, errPollNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	broadcastPoll("poll-updated", &updated, "")
+	return &updated, nil
+}
+
+// closePoll stops a poll taking votes and sends everyone the final tallies
+func closePoll(meeting *Meeting, actorID string, pollID primitive.ObjectID) (*Poll, error) {
+	if !isMeetingHost(meeting, actorID) {
+		return nil, errNotHost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var poll Poll
+	err := db.Collection("polls").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": pollID, "meeting_id": meeting.MeetingID, "closed": false},
+		bson.M{"$set": bson.M{"closed": true, "closed_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&poll)
+	if err == mongo.ErrNoDocuments {
+		// Already closed, which keeps the first closing time, or never there
+		if _, err := loadPoll(ctx, meeting.MeetingID, pollID); err != nil {
+			return nil, err
+		}
+		return nil, errPollClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %s closed poll %s in meeting %s", actorID, pollID.Hex(), meeting.MeetingID)
+
+	broadcastPoll("poll-closed", &poll, actorID)
+	return &poll, nil
+}
+
+// closeMeetingPolls closes whatever polls were still open when a meeting
+// ended, so the results listed afterwards are final
+func closeMeetingPolls(meetingID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("polls").UpdateMany(
+		ctx,
+		bson.M{"meeting_id": meetingID, "closed": false},
+		bson.M{"$set": bson.M{"closed": true, "closed_at": time.Now()}},
+	)
+	if err != nil {
+		log.Printf("Failed to close polls in meeting %s: %v", meetingID, err)
+	}
+}
+
+func pollErrorMessage(err error) string {
+	switch err {
+	case errNotHost, errPollNotFound, errPollClosed, errAlreadyVoted, errInvalidPoll, errInvalidChoice, errInvalidChoices:
+		return err.Error()
+	}
+	return "Failed to update poll"
+}
+
+// handlePollCommand serves poll-create, poll-vote and poll-close over the
+// socket
+func (c *Connection) handlePollCommand(msg WebSocketMessage) {
+	var data struct {
+		PollID    string   `json:"pollId"`
+		Question  string   `json:"question"`
+		Options   []string `json:"options"`
+		Multiple  bool     `json:"multiple"`
+		Anonymous bool     `json:"anonymous"`
+		Choices   []int    `json:"choices"`
+	}
+	if err := decodeData(msg.Data, &data); err != nil {
+		c.sendError("Invalid " + msg.Type + " message")
+		return
+	}
+
+	var pollID primitive.ObjectID
+	var err error
+	if msg.Type != "poll-create" {
+		if pollID, err = primitive.ObjectIDFromHex(data.PollID); err != nil {
+			c.sendError("Invalid poll ID")
+			return
+		}
+	}
+
+	switch msg.Type {
+	case "poll-create":
+		var meeting *Meeting
+		if meeting, err = loadMeeting(c.meetingID); err == nil {
+			_, err = createPoll(meeting, c, data.Question, data.Options, data.Multiple, data.Anonymous)
+		}
+	case "poll-vote":
+		_, err = votePoll(c.meetingID, c.userID, pollID, data.Choices)
+	case "poll-close":
+		var meeting *Meeting
+		if meeting, err = loadMeeting(c.meetingID); err == nil {
+			_, err = closePoll(meeting, c.userID, pollID)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed %s by user %s in meeting %s: %v", msg.Type, c.userID, c.meetingID, err)
+		c.sendError(pollErrorMessage(err))
+	}
+}
+
+// getPollsHandler serves GET /meeting/:id/polls, every poll asked in the
+// meeting with its tallies, oldest first
+func getPollsHandler(c *gin.Context) {
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleParticipant)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := db.Collection("polls").Find(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch polls"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	polls := []Poll{}
+	if err := cursor.All(ctx, &polls); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to decode polls"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"polls": polls,
+		"count": len(polls),
+	})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Where a question is in the Q&A queue
+const (
+	questionStatusOpen      = "open"
+	questionStatusAnswered  = "answered"
+	questionStatusDismissed = "dismissed"
+)
+
+const (
+	maxQuestionLength = 500
+	// maxQueueLength caps how many open questions are pushed to clients
+	maxQueueLength = 200
+)
+
+var (
+	errQuestionNotFound = errors.New("question not found")
+	errQuestionClosed   = errors.New("question has already been answered or dismissed")
+	errEmptyQuestion    = errors.New("question must be 1 to 500 characters")
+	errAlreadyUpvoted   = errors.New("you have already upvoted this question")
+	errNotUpvoted       = errors.New("you have not upvoted this question")
+)
+
+// Question is one entry in a meeting's Q&A queue, kept apart from the chat.
+// Anonymous questions never store who asked them.
+type Question struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	MeetingID   string             `bson:"meeting_id" json:"meeting_id"`
+	Text        string             `bson:"text" json:"text"`
+	Anonymous   bool               `bson:"anonymous" json:"anonymous"`
+	AuthorID    string             `bson:"author_id,omitempty" json:"author_id,omitempty"`
+	AuthorName  string             `bson:"author_name,omitempty" json:"author_name,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	Votes       int                `bson:"votes" json:"votes"`
+	Upvoters    []string           `bson:"upvoters" json:"-"`
+	Status      string             `bson:"status" json:"status"`
+	ModeratedBy string             `bson:"moderated_by,omitempty" json:"moderated_by,omitempty"`
+	ModeratedAt *time.Time         `bson:"moderated_at,omitempty" json:"moderated_at,omitempty"`
+}
+
+// questionQueueSort puts the most upvoted first, and the oldest first of
+// those with the same votes
+var questionQueueSort = bson.D{{Key: "votes", Value: -1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}
+
+func ensureQuestionIndexes(ctx context.Context) error {
+	_, err := db.Collection("questions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "meeting_id", Value: 1}, {Key: "status", Value: 1}, {Key: "votes", Value: -1}, {Key: "created_at", Value: 1}},
+	})
+	return err
+}
+
+func loadQuestion(ctx context.Context, meetingID string, questionID primitive.ObjectID) (*Question, error) {
+	var question Question
+	err := db.Collection("questions").FindOne(ctx, bson.M{"_id": questionID, "meeting_id": meetingID}).Decode(&question)
+	if err == mongo.ErrNoDocuments {
+		return nil, errQuestionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &question, nil
+}
+
+// questionQueue loads a meeting's open questions in queue order
+func questionQueue(meetingID string) ([]Question, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.Collection("questions").Find(
+		ctx,
+		bson.M{"meeting_id": meetingID, "status": questionStatusOpen},
+		options.Find().SetSort(questionQueueSort).SetLimit(maxQueueLength),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	questions := []Question{}
+	if err := cursor.All(ctx, &questions); err != nil {
+		return nil, err
+	}
+	return questions, nil
+}
+
+func questionQueueMessage(meetingID string, questions []Question) WebSocketMessage {
+	return WebSocketMessage{
+		Type:      "question-queue",
+		Data:      map[string]interface{}{"questions": questions},
+		MeetingID: meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+}
+
+// pushQuestionQueue sends everyone in the meeting the queue as it now stands.
+// The whole queue goes each time so clients never have to re-sort it.
+func pushQuestionQueue(meetingID string) {
+	questions, err := questionQueue(meetingID)
+	if err != nil {
+		log.Printf("Failed to load question queue for meeting %s: %v", meetingID, err)
+		return
+	}
+	broadcastEvent(meetingID, questionQueueMessage(meetingID, questions))
+}
+
+// sendQuestionQueue gives a user who just joined the current queue
+func (c *Connection) sendQuestionQueue() {
+	questions, err := questionQueue(c.meetingID)
+	if err != nil {
+		log.Printf("Failed to load question queue for meeting %s: %v", c.meetingID, err)
+		return
+	}
+	if len(questions) == 0 {
+		return
+	}
+	c.sendMessage(questionQueueMessage(c.meetingID, questions))
+}
+
+// askQuestion adds a question to the meeting's queue
+func askQuestion(conn *Connection, text string, anonymous bool) (*Question, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || utf8.RuneCountInString(text) > maxQuestionLength {
+		return nil, errEmptyQuestion
+	}
+
+	question := Question{
+		MeetingID: conn.meetingID,
+		Text:      text,
+		Anonymous: anonymous,
+		CreatedAt: time.Now(),
+		Upvoters:  []string{},
+		Status:    questionStatusOpen,
+	}
+	if !anonymous {
+		question.AuthorID = conn.userID
+		question.AuthorName = conn.userName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("questions").InsertOne(ctx, question)
+	if err != nil {
+		return nil, err
+	}
+	question.ID = result.InsertedID.(primitive.ObjectID)
+
+	pushQuestionQueue(conn.meetingID)
+	return &question, nil
+}
+
+// upvoteQuestion adds or takes back the user's vote for an open question
+func upvoteQuestion(meetingID, userID string, questionID primitive.ObjectID, remove bool) (*Question, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Filtered on the upvoters so a vote only ever counts once
+	filter := bson.M{"_id": questionID, "meeting_id": meetingID, "status": questionStatusOpen}
+	update := bson.M{"$push": bson.M{"upvoters": userID}, "$inc": bson.M{"votes": 1}}
+	if remove {
+		filter["upvoters"] = userID
+		update = bson.M{"$pull": bson.M{"upvoters": userID}, "$inc": bson.M{"votes": -1}}
+	} else {
+		filter["upvoters"] = bson.M{"$ne": userID}
+	}
+
+	var question Question
+	err := db.Collection("questions").FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&question)
+	if err == mongo.ErrNoDocuments {
+		existing, err := loadQuestion(ctx, meetingID, questionID)
+		if err != nil {
+			return nil, err
+		}
+		if existing.Status != questionStatusOpen {
+			return nil, errQuestionClosed
+		}
+		if remove {
+			return nil, errNotUpvoted
+		}
+		return nil, errAlreadyUpvoted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pushQuestionQueue(meetingID)
+	return &question, nil
+}
+
+// moderateQuestion marks an open question answered or dismissed, taking it
+// out of the queue. Only hosts can.
+func moderateQuestion(meeting *Meeting, actorID string, questionID primitive.ObjectID, status string) (*Question, error) {
+	if !isMeetingHost(meeting, actorID) {
+		return nil, errNotHost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var question Question
+	err := db.Collection("questions").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": questionID, "meeting_id": meeting.MeetingID, "status": questionStatusOpen},
+		bson.M{"$set": bson.M{"status": status, "moderated_by": actorID, "moderated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&question)
+	if err == mongo.ErrNoDocuments {
+		if _, err := loadQuestion(ctx, meeting.MeetingID, questionID); err != nil {
+			return nil, err
+		}
+		return nil, errQuestionClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %s marked question %s %s in meeting %s", actorID, questionID.Hex(), status, meeting.MeetingID)
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:      "question-" + status,
+		Data:      question,
+		UserID:    actorID,
+		MeetingID: meeting.MeetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+		ID:        question.ID.Hex(),
+	})
+	pushQuestionQueue(meeting.MeetingID)
+	return &question, nil
+}
+
+func questionErrorMessage(err error) string {
+	switch err {
+	case errNotHost, errQuestionNotFound, errQuestionClosed, errEmptyQuestion, errAlreadyUpvoted, errNotUpvoted:
+		return err.Error()
+	}
+	return "Failed to update question"
+}
+
+// handleQuestionCommand serves question-ask, question-upvote,
+// question-answer and question-dismiss over the socket
+func (c *Connection) handleQuestionCommand(msg WebSocketMessage) {
+	var data struct {
+		QuestionID string `json:"questionId"`
+		Text       string `json:"text"`
+		Anonymous  bool   `json:"anonymous"`
+		Remove     bool   `json:"remove"`
+	}
+	if err := decodeData(msg.Data, &data); err != nil {
+		c.sendError("Invalid " + msg.Type + " message")
+		return
+	}
+
+	var questionID primitive.ObjectID
+	var err error
+	if msg.Type != "question-ask" {
+		if questionID, err = primitive.ObjectIDFromHex(data.QuestionID); err != nil {
+			c.sendError("Invalid question ID")
+			return
+		}
+	}
+
+	switch msg.Type {
+	case "question-ask":
+		_, err = askQuestion(c, data.Text, data.Anonymous)
+	case "question-upvote":
+		_, err = upvoteQuestion(c.meetingID, c.userID, questionID, data.Remove)
+	case "question-answer", "question-dismiss":
+		status := questionStatusAnswered
+		if msg.Type == "question-dismiss" {
+			status = questionStatusDismissed
+		}
+		var meeting *Meeting
+		if meeting, err = loadMeeting(c.meetingID); err == nil {
+			_, err = moderateQuestion(meeting, c.userID, questionID, status)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed %s by user %s in meeting %s: %v", msg.Type, c.userID, c.meetingID, err)
+		c.sendError(questionErrorMessage(err))
+	}
+}
+
+// questionsHandler serves GET /meeting/:id/questions, every question asked
+// in the meeting in queue order, as JSON or, with ?format=csv, as a CSV
+// download. Dismissed questions are only listed for hosts.
+func questionsHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(400, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleParticipant)
+	if !ok {
+		return
+	}
+	filter := bson.M{"meeting_id": meeting.MeetingID}
+	if !isMeetingHost(meeting, claims.UserID) {
+		filter["status"] = bson.M{"$ne": questionStatusDismissed}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := db.Collection("questions").Find(ctx, filter, options.Find().SetSort(questionQueueSort))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch questions"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	questions := []Question{}
+	if err := cursor.All(ctx, &questions); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to decode questions"})
+		return
+	}
+
+	if format == "json" {
+		c.JSON(200, gin.H{
+			"meeting_id": meeting.MeetingID,
+			"questions":  questions,
+			"count":      len(questions),
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meeting.MeetingID+"-questions.csv"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(200)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"id", "asked_at", "author", "author_id", "question", "votes", "status", "moderated_at"})
+	for _, question := range questions {
+		author := question.AuthorName
+		if question.Anonymous {
+			author = "Anonymous"
+		}
+		moderatedAt := ""
+		if question.ModeratedAt != nil {
+			moderatedAt = question.ModeratedAt.UTC().Format(time.RFC3339)
+		}
+		writer.Write([]string{
+			question.ID.Hex(),
+			question.CreatedAt.UTC().Format(time.RFC3339),
+			csvSafe(author),
+			question.AuthorID,
+			csvSafe(question.Text),
+			strconv.Itoa(question.Votes),
+			question.Status,
+			moderatedAt,
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Failed to write questions CSV for meeting %s: %v", meeting.MeetingID, err)
+	}
+}
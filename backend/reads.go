@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChatReadMarker is the last chat message a user has read in a meeting
+type ChatReadMarker struct {
+	MeetingID  string             `bson:"meeting_id" json:"meeting_id"`
+	UserID     string             `bson:"user_id" json:"user_id"`
+	LastReadID primitive.ObjectID `bson:"last_read_id" json:"last_read_id"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+func ensureReadMarkerIndexes(ctx context.Context) error {
+	_, err := db.Collection("chat_reads").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "meeting_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// markChatRead moves the user's read marker forward to messageID. Markers
+// never move back, so a late marker from another device is ignored.
+func markChatRead(meetingID, userID string, messageID primitive.ObjectID) (*ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	message, err := loadChatMessage(ctx, meetingID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if !message.visibleTo(userID) {
+		return nil, errChatMessageNotFound
+	}
+
+	// When the stored marker is already further on the filter misses it and
+	// the upsert collides with the unique index, which is fine
+	_, err = db.Collection("chat_reads").UpdateOne(
+		ctx,
+		bson.M{
+			"meeting_id":   meetingID,
+			"user_id":      userID,
+			"last_read_id": bson.M{"$lt": messageID},
+		},
+		bson.M{"$set": bson.M{"last_read_id": messageID, "updated_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+	return message, nil
+}
+
+// unreadCount counts the messages others posted in a meeting since the
+// user's read marker, or ever if they have none
+func unreadCount(meetingID, userID string) (int64, *primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"meeting_id": meetingID,
+		"user_id":    bson.M{"$ne": userID},
+		"deleted":    bson.M{"$ne": true},
+		"$and":       []bson.M{visibleChatFilter(userID)},
+	}
+
+	var marker ChatReadMarker
+	err := db.Collection("chat_reads").FindOne(ctx, bson.M{"meeting_id": meetingID, "user_id": userID}).Decode(&marker)
+	switch err {
+	case nil:
+		filter["_id"] = bson.M{"$gt": marker.LastReadID}
+	case mongo.ErrNoDocuments:
+	default:
+		return 0, nil, err
+	}
+
+	count, err := db.Collection("chat_messages").CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, nil, err
+	}
+	if marker.LastReadID.IsZero() {
+		return count, nil, nil
+	}
+	return count, &marker.LastReadID, nil
+}
+
+// sendUnreadCount tells a user who just joined how much chat they missed
+func (c *Connection) sendUnreadCount() {
+	count, lastReadID, err := unreadCount(c.meetingID, c.userID)
+	if err != nil {
+		log.Printf("Failed to count unread messages for user %s in meeting %s: %v", c.userID, c.meetingID, err)
+		return
+	}
+
+	data := map[string]interface{}{"count": count}
+	if lastReadID != nil {
+		data["lastReadId"] = lastReadID.Hex()
+	}
+	c.sendMessage(WebSocketMessage{
+		Type:      "unread-count",
+		Data:      data,
+		UserID:    c.userID,
+		MeetingID: c.meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// handleChatRead records a chat-read marker and lets the people who can see
+// the message know it was read
+func (c *Connection) handleChatRead(msg WebSocketMessage) {
+	var data struct {
+		MessageID string `json:"messageId"`
+	}
+	if err := decodeData(msg.Data, &data); err != nil {
+		c.sendError("Invalid chat-read message")
+		return
+	}
+	messageID, err := primitive.ObjectIDFromHex(data.MessageID)
+	if err != nil {
+		c.sendError("Invalid message ID")
+		return
+	}
+	// Clients tend to repeat the marker on every render
+	if messageID == c.lastReadID {
+		return
+	}
+
+	message, err := markChatRead(c.meetingID, c.userID, messageID)
+	if err != nil {
+		log.Printf("Failed to mark message %s read for user %s: %v", data.MessageID, c.userID, err)
+		c.sendError(chatErrorMessage(err))
+		return
+	}
+	c.lastReadID = messageID
+
+	c.hub.sendChatEvent(message, WebSocketMessage{
+		Type:      "chat-read",
+		Data:      map[string]string{"messageId": data.MessageID},
+		UserID:    c.userID,
+		UserName:  c.userName,
+		MeetingID: c.meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+		ID:        data.MessageID,
+	})
+}
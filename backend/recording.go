@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Recording is the metadata stored for a server-side meeting recording
+type Recording struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	MeetingID    string             `bson:"meeting_id" json:"meeting_id"`
+	Status       string             `bson:"status" json:"status"`
+	StartedBy    string             `bson:"started_by" json:"started_by"`
+	StoppedBy    string             `bson:"stopped_by,omitempty" json:"stopped_by,omitempty"`
+	Participants []string           `bson:"participants" json:"participants"`
+	Files        []RecordingFile    `bson:"files" json:"files"`
+	StartedAt    time.Time          `bson:"started_at" json:"started_at"`
+	StoppedAt    *time.Time         `bson:"stopped_at,omitempty" json:"stopped_at,omitempty"`
+	Duration     float64            `bson:"duration_seconds" json:"duration_seconds"`
+	// Packets the disk could not keep up with
+	DroppedPackets int64 `bson:"dropped_packets" json:"dropped_packets"`
+}
+
+// RecordingFile is one participant track written to disk
+type RecordingFile struct {
+	UserID   string `bson:"user_id" json:"user_id"`
+	Kind     string `bson:"kind" json:"kind"`
+	MimeType string `bson:"mime_type" json:"mime_type"`
+	Path     string `bson:"path" json:"path"`
+}
+
+const (
+	recordingStatusActive    = "recording"
+	recordingStatusCompleted = "completed"
+)
+
+var (
+	errRecordingUnsupported = errors.New("recording requires a meeting in sfu media mode")
+	errAlreadyRecording     = errors.New("meeting is already being recorded")
+	errNotRecording         = errors.New("meeting is not being recorded")
+)
+
+// Recorders for meetings currently being recorded, keyed by meeting ID
+var (
+	activeRecordings = make(map[string]*meetingRecorder)
+	recordingsMutex  sync.Mutex
+)
+
+// recordingQueueSize is how many packets of one track can wait for the
+// disk, a few seconds of video
+const recordingQueueSize = 1024
+
+// meetingRecorder writes each forwarded track of a meeting to its own file.
+// The SFU hands it packets from its forwarding loop, so nothing here may wait
+// on the disk there; each track is written by its own goroutine instead.
+type meetingRecorder struct {
+	recording    *Recording
+	dir          string
+	tracks       map[string]*trackRecorder
+	skipped      map[string]bool // tracks whose codec cannot be written
+	participants map[string]bool
+	closed       bool
+	mutex        sync.Mutex
+}
+
+// trackRecorder queues one track's packets for the goroutine writing them
+type trackRecorder struct {
+	packets chan *rtp.Packet
+	done    chan struct{}
+}
+
+// WriteRTP implements trackSink. A packet the track's queue has no room for
+// is dropped and counted.
+func (r *meetingRecorder) WriteRTP(userID string, track *webrtc.TrackRemote, packet *rtp.Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	key := userID + "/" + track.ID()
+	if r.skipped[key] {
+		return
+	}
+	recorder, exists := r.tracks[key]
+	if !exists {
+		recorder = &trackRecorder{
+			packets: make(chan *rtp.Packet, recordingQueueSize),
+			done:    make(chan struct{}),
+		}
+		r.tracks[key] = recorder
+		go r.record(key, userID, track, recorder)
+	}
+
+	// The forwarding loop reuses its packet and buffer, so queue a copy
+	select {
+	case recorder.packets <- packet.Clone():
+	default:
+		if r.recording.DroppedPackets == 0 {
+			log.Printf("Recording: disk is falling behind, dropping packets of track %s", key)
+		}
+		r.recording.DroppedPackets++
+	}
+}
+
+// record writes a track's packets to its file until the recorder closes
+func (r *meetingRecorder) record(key, userID string, track *webrtc.TrackRemote, recorder *trackRecorder) {
+	defer close(recorder.done)
+
+	writer, file, err := newTrackWriter(r.dir, userID, track)
+	r.mutex.Lock()
+	if err != nil {
+		log.Printf("Recording: skipping track %s of user %s: %v", track.ID(), userID, err)
+		r.skipped[key] = true
+	} else {
+		r.recording.Files = append(r.recording.Files, file)
+		r.participants[userID] = true
+	}
+	r.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	for packet := range recorder.packets {
+		if err := writer.WriteRTP(packet); err != nil {
+			log.Printf("Recording: failed to write packet for user %s: %v", userID, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Recording: failed to close %s: %v", key, err)
+	}
+}
+
+// close finalizes every file and fills in the recording's closing metadata
+func (r *meetingRecorder) close(stoppedBy string) *Recording {
+	r.mutex.Lock()
+	r.closed = true
+	tracks := make([]*trackRecorder, 0, len(r.tracks))
+	for _, recorder := range r.tracks {
+		close(recorder.packets)
+		tracks = append(tracks, recorder)
+	}
+	r.mutex.Unlock()
+
+	// The writers finish what is queued and take the lock as they start
+	for _, recorder := range tracks {
+		<-recorder.done
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stoppedAt := time.Now()
+	r.recording.Status = recordingStatusCompleted
+	r.recording.StoppedBy = stoppedBy
+	r.recording.StoppedAt = &stoppedAt
+	r.recording.Duration = stoppedAt.Sub(r.recording.StartedAt).Seconds()
+	r.recording.Participants = r.recording.Participants[:0]
+	for userID := range r.participants {
+		r.recording.Participants = append(r.recording.Participants, userID)
+	}
+	if r.recording.DroppedPackets > 0 {
+		log.Printf("Recording %s dropped %d packets the disk could not keep up with", r.recording.ID.Hex(), r.recording.DroppedPackets)
+	}
+	return r.recording
+}
+
+// newTrackWriter picks a container for the track's codec: Ogg for Opus,
+// IVF for VP8/VP9/AV1 and an Annex B stream for H.264
+func newTrackWriter(dir, userID string, track *webrtc.TrackRemote) (media.Writer, RecordingFile, error) {
+	codec := track.Codec()
+	base := filepath.Join(dir, safeFileName(userID)+"-"+safeFileName(track.ID()))
+	file := RecordingFile{
+		UserID:   userID,
+		Kind:     track.Kind().String(),
+		MimeType: codec.MimeType,
+	}
+
+	var writer media.Writer
+	var err error
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		file.Path = base + ".ogg"
+		writer, err = oggwriter.New(file.Path, codec.ClockRate, codec.Channels)
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		file.Path = base + ".ivf"
+		writer, err = ivfwriter.New(file.Path, ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		file.Path = base + ".ivf"
+		writer, err = ivfwriter.New(file.Path, ivfwriter.WithCodec(webrtc.MimeTypeVP9))
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeAV1):
+		file.Path = base + ".ivf"
+		writer, err = ivfwriter.New(file.Path, ivfwriter.WithCodec(webrtc.MimeTypeAV1))
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		file.Path = base + ".h264"
+		writer, err = h264writer.New(file.Path)
+	default:
+		return nil, file, fmt.Errorf("unsupported codec %s", codec.MimeType)
+	}
+	if err != nil {
+		return nil, file, err
+	}
+	return writer, file, nil
+}
+
+// startRecording begins writing a meeting's media to disk and tells the room
+func startRecording(meeting *Meeting, startedBy string) (*Recording, error) {
+	if meeting.MediaMode != mediaModeSFU {
+		return nil, errRecordingUnsupported
+	}
+
+	recordingsMutex.Lock()
+	if _, active := activeRecordings[meeting.MeetingID]; active {
+		recordingsMutex.Unlock()
+		return nil, errAlreadyRecording
+	}
+
+	startedAt := time.Now()
+	dir := filepath.Join(recordingsDir(), safeFileName(meeting.MeetingID), startedAt.UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		recordingsMutex.Unlock()
+		return nil, err
+	}
+
+	recording := &Recording{
+		MeetingID:    meeting.MeetingID,
+		Status:       recordingStatusActive,
+		StartedBy:    startedBy,
+		Participants: []string{},
+		Files:        []RecordingFile{},
+		StartedAt:    startedAt,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("recordings").InsertOne(ctx, recording)
+	if err != nil {
+		recordingsMutex.Unlock()
+		return nil, err
+	}
+	recording.ID = result.InsertedID.(primitive.ObjectID)
+
+	// The recorder keeps mutating recording, so callers get a copy
+	snapshot := *recording
+
+	// Everyone present when recording starts is on the record, publishing or not
+	recorder := &meetingRecorder{
+		recording:    recording,
+		dir:          dir,
+		tracks:       make(map[string]*trackRecorder),
+		skipped:      make(map[string]bool),
+		participants: make(map[string]bool),
+	}
+	for _, participant := range hub.participants(meeting.MeetingID) {
+		recorder.participants[participant.UserID] = true
+	}
+
+	activeRecordings[meeting.MeetingID] = recorder
+	mediaServer.SetSink(meeting.MeetingID, recorder)
+	recordingsMutex.Unlock()
+
+	log.Printf("Recording %s started in meeting %s by user %s", recording.ID.Hex(), meeting.MeetingID, startedBy)
+
+	broadcastEvent(meeting.MeetingID, WebSocketMessage{
+		Type:      "recording-started",
+		Data:      snapshot,
+		UserID:    startedBy,
+		MeetingID: meeting.MeetingID,
+		Timestamp: startedAt.Format(time.RFC3339),
+	})
+	return &snapshot, nil
+}
+
+// stopRecording finalizes a meeting's recording, stores its metadata and
+// tells the room. stoppedBy is empty when the server stops it on its own.
+func stopRecording(meetingID, stoppedBy string) (*Recording, error) {
+	recordingsMutex.Lock()
+	recorder, active := activeRecordings[meetingID]
+	if !active {
+		recordingsMutex.Unlock()
+		return nil, errNotRecording
+	}
+	delete(activeRecordings, meetingID)
+	mediaServer.ClearSink(meetingID)
+	recordingsMutex.Unlock()
+
+	recording := recorder.close(stoppedBy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("recordings").UpdateOne(
+		ctx,
+		bson.M{"_id": recording.ID},
+		bson.M{"$set": bson.M{
+			"status":           recording.Status,
+			"stopped_by":       recording.StoppedBy,
+			"stopped_at":       recording.StoppedAt,
+			"duration_seconds": recording.Duration,
+			"participants":     recording.Participants,
+			"files":            recording.Files,
+			"dropped_packets":  recording.DroppedPackets,
+		}},
+	)
+	if err != nil {
+		log.Printf("Failed to save recording %s: %v", recording.ID.Hex(), err)
+	}
+
+	log.Printf("Recording %s stopped in meeting %s after %.0fs", recording.ID.Hex(), meetingID, recording.Duration)
+
+	broadcastEvent(meetingID, WebSocketMessage{
+		Type:      "recording-stopped",
+		Data:      recording,
+		UserID:    stoppedBy,
+		MeetingID: meetingID,
+		Timestamp: recording.StoppedAt.Format(time.RFC3339),
+	})
+	return recording, nil
+}
+
+// addParticipant puts someone who joined mid-recording on the record and
+// returns a copy of the recording, or nil once it has stopped
+func (r *meetingRecorder) addParticipant(userID string) *Recording {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.participants[userID] = true
+	snapshot := *r.recording
+	return &snapshot
+}
+
+// sendRecordingState tells a user who just joined that the meeting is being
+// recorded, since they missed recording-started
+func (c *Connection) sendRecordingState() {
+	recordingsMutex.Lock()
+	recorder, active := activeRecordings[c.meetingID]
+	recordingsMutex.Unlock()
+	if !active {
+		return
+	}
+
+	recording := recorder.addParticipant(c.userID)
+	if recording == nil {
+		return
+	}
+	c.sendMessage(WebSocketMessage{
+		Type:      "recording-started",
+		Data:      recording,
+		UserID:    recording.StartedBy,
+		MeetingID: c.meetingID,
+		Timestamp: recording.StartedAt.Format(time.RFC3339),
+	})
+}
+
+// stopRecordingIfActive is used when a meeting empties out
+func stopRecordingIfActive(meetingID string) {
+	if _, err := stopRecording(meetingID, ""); err != nil && err != errNotRecording {
+		log.Printf("Failed to stop recording for meeting %s: %v", meetingID, err)
+	}
+}
+
+func (c *Connection) handleRecording(msg WebSocketMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var meeting Meeting
+	if err := db.Collection("meetings").FindOne(ctx, bson.M{"meeting_id": c.meetingID}).Decode(&meeting); err != nil {
+		c.sendError("Meeting not found")
+		return
+	}
+
+	if !isMeetingHost(&meeting, c.userID) {
+		c.sendError("Only the host can control recording")
+		return
+	}
+
+	var err error
+	if msg.Type == "start-recording" {
+		_, err = startRecording(&meeting, c.userID)
+	} else {
+		_, err = stopRecording(c.meetingID, c.userID)
+	}
+	if err != nil {
+		c.sendError(err.Error())
+	}
+}
+
+func recordingHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	var recordingData struct {
+		Action string `json:"action"`
+	}
+
+	if err := c.ShouldBindJSON(&recordingData); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+
+	var recording *Recording
+	var err error
+	switch recordingData.Action {
+	case "start":
+		recording, err = startRecording(meeting, claims.UserID)
+	case "stop":
+		recording, err = stopRecording(meeting.MeetingID, claims.UserID)
+	default:
+		c.JSON(400, gin.H{"error": "action must be start or stop"})
+		return
+	}
+
+	switch err {
+	case nil:
+	case errRecordingUnsupported, errAlreadyRecording, errNotRecording:
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(500, gin.H{"error": "Failed to " + recordingData.Action + " recording"})
+		return
+	}
+
+	status := 200
+	if recordingData.Action == "start" {
+		status = 201
+	}
+	c.JSON(status, gin.H{
+		"message":   "Recording " + recording.Status,
+		"recording": recording,
+	})
+}
+
+func recordingsDir() string {
+	if dir := os.Getenv("RECORDINGS_DIR"); dir != "" {
+		return dir
+	}
+	return "recordings"
+}
+
+// safeFileName keeps letters, digits, dashes and underscores so client
+// supplied IDs cannot escape the recording directory
+func safeFileName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	if safe == "" {
+		return "_"
+	}
+	return safe
+}
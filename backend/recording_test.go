@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJoiningDuringRecordingIsTold(t *testing.T) {
+	useUnreachableDatabase(t)
+
+	const meetingID = "rec-ordi-ngx"
+	h := startTestHub(t, newMemoryBus(), "node-a")
+
+	// What startRecording leaves behind, without the database and SFU it needs
+	startedAt := time.Now()
+	recorder := &meetingRecorder{
+		recording: &Recording{
+			MeetingID:    meetingID,
+			Status:       recordingStatusActive,
+			StartedBy:    "host",
+			Participants: []string{},
+			Files:        []RecordingFile{},
+			StartedAt:    startedAt,
+		},
+		tracks:       make(map[string]*trackRecorder),
+		skipped:      make(map[string]bool),
+		participants: map[string]bool{"host": true},
+	}
+	recordingsMutex.Lock()
+	activeRecordings[meetingID] = recorder
+	recordingsMutex.Unlock()
+	t.Cleanup(func() {
+		recordingsMutex.Lock()
+		delete(activeRecordings, meetingID)
+		recordingsMutex.Unlock()
+	})
+
+	latecomer := joinTestHub(h, meetingID, "latecomer")
+	started := expectMessage(t, latecomer, "recording-started")
+	if started.UserID != "host" {
+		t.Errorf("recording-started names %q as the one who started it, want host", started.UserID)
+	}
+	if started.Timestamp != startedAt.Format(time.RFC3339) {
+		t.Errorf("recording-started at %s, want when it started, %s", started.Timestamp, startedAt.Format(time.RFC3339))
+	}
+
+	recording := recorder.close("host")
+	if !containsString(recording.Participants, "latecomer") {
+		t.Errorf("recording participants %v leave out the latecomer", recording.Participants)
+	}
+}
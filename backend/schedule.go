@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/teambition/rrule-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultUpcomingRange = 30 * 24 * time.Hour
+	maxUpcomingRange     = 366 * 24 * time.Hour
+	maxOccurrences       = 500 // per meeting in one upcoming query
+	icsTimezoneYears     = 10  // how far ahead VTIMEZONE covers an open-ended series
+	maxRRuleCount        = 1000
+	maxRRuleYears        = 10 // how far ahead UNTIL can be
+	icsDateTime          = "20060102T150405"
+)
+
+var (
+	errScheduleIncomplete = errors.New("startTime and endTime are both required to schedule a meeting")
+	errScheduleOrder      = errors.New("endTime must be after startTime")
+	errInvalidTimeZone    = errors.New("timeZone must be an IANA time zone such as Europe/Berlin")
+	errInvalidRRule       = errors.New("rrule must be a valid RFC 5545 recurrence rule")
+	errRRuleTooFrequent   = errors.New("meetings cannot recur more often than hourly")
+	errRRuleTooLong       = errors.New("rrule COUNT cannot exceed 1000 and UNTIL must be within 10 years")
+	errInvalidInvitee     = errors.New("invitees must be email addresses")
+	errNotRecurring       = errors.New("meeting is not a recurring series")
+	errNotAnOccurrence    = errors.New("originalStart is not an occurrence of this series")
+)
+
+// OccurrenceException cancels or moves one occurrence of a recurring
+// meeting, identified by the start it would have had
+type OccurrenceException struct {
+	OriginalStart time.Time  `bson:"original_start" json:"original_start"`
+	Cancelled     bool       `bson:"cancelled" json:"cancelled"`
+	Start         *time.Time `bson:"start,omitempty" json:"start,omitempty"`
+	End           *time.Time `bson:"end,omitempty" json:"end,omitempty"`
+}
+
+// Occurrence is one concrete sitting of a scheduled meeting
+type Occurrence struct {
+	MeetingID     string     `json:"meeting_id"`
+	Title         string     `json:"title"`
+	Start         time.Time  `json:"start"`
+	End           time.Time  `json:"end"`
+	TimeZone      string     `json:"time_zone"`
+	Recurring     bool       `json:"recurring"`
+	OriginalStart *time.Time `json:"original_start,omitempty"` // set when the occurrence was moved
+	JoinURL       string     `json:"join_url"`
+}
+
+// ScheduleInput is the scheduling part of a create meeting request
+type ScheduleInput struct {
+	StartTime *time.Time `json:"startTime"`
+	EndTime   *time.Time `json:"endTime"`
+	TimeZone  string     `json:"timeZone"`
+	RRule     string     `json:"rrule"`
+	Invitees  []string   `json:"invitees"`
+}
+
+// applySchedule validates input and copies it onto meeting. Every error it
+// returns is a validation error.
+func applySchedule(meeting *Meeting, input ScheduleInput) error {
+	if input.StartTime == nil && input.EndTime == nil {
+		if input.RRule != "" || input.TimeZone != "" {
+			return errScheduleIncomplete
+		}
+	} else {
+		if input.StartTime == nil || input.EndTime == nil {
+			return errScheduleIncomplete
+		}
+		if !input.EndTime.After(*input.StartTime) {
+			return errScheduleOrder
+		}
+
+		timeZone := input.TimeZone
+		if timeZone == "" {
+			timeZone = "UTC"
+		}
+		if _, err := time.LoadLocation(timeZone); err != nil {
+			return errInvalidTimeZone
+		}
+
+		start, end := input.StartTime.UTC(), input.EndTime.UTC()
+		meeting.StartTime = &start
+		meeting.EndTime = &end
+		meeting.TimeZone = timeZone
+
+		if input.RRule != "" {
+			rule, err := normalizeRRule(input.RRule)
+			if err != nil {
+				return err
+			}
+			meeting.RRule = rule
+		}
+	}
+
+	for _, invitee := range input.Invitees {
+		invitee = strings.ToLower(strings.TrimSpace(invitee))
+		if !strings.Contains(invitee, "@") || strings.ContainsAny(invitee, " \r\n,;") {
+			return errInvalidInvitee
+		}
+		if !containsString(meeting.Invitees, invitee) {
+			meeting.Invitees = append(meeting.Invitees, invitee)
+		}
+	}
+	return nil
+}
+
+// normalizeRRule checks a recurrence rule and returns it in canonical form,
+// without the "RRULE:" prefix
+func normalizeRRule(rule string) (string, error) {
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	if strings.ContainsAny(rule, "\r\n") {
+		return "", errInvalidRRule
+	}
+
+	option, err := rrule.StrToROption(rule)
+	if err != nil {
+		return "", errInvalidRRule
+	}
+	if option.Freq == rrule.MINUTELY || option.Freq == rrule.SECONDLY {
+		return "", errRRuleTooFrequent
+	}
+	if option.Count > maxRRuleCount || option.Until.After(time.Now().AddDate(maxRRuleYears, 0, 0)) {
+		return "", errRRuleTooLong
+	}
+	if _, err := rrule.NewRRule(*option); err != nil {
+		return "", errInvalidRRule
+	}
+	return option.RRuleString(), nil
+}
+
+func (m *Meeting) location() *time.Location {
+	if loc, err := time.LoadLocation(m.TimeZone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+func (m *Meeting) scheduled() bool {
+	return m.StartTime != nil && m.EndTime != nil
+}
+
+// recurrence expands the series in the meeting's own time zone, so it keeps
+// its wall clock time across daylight saving changes
+func (m *Meeting) recurrence() (*rrule.RRule, error) {
+	loc := m.location()
+	option, err := rrule.StrToROptionInLocation(m.RRule, loc)
+	if err != nil {
+		return nil, err
+	}
+	option.Dtstart = m.StartTime.In(loc)
+	return rrule.NewRRule(*option)
+}
+
+// isOccurrence reports whether start is one of the series' original starts
+func (m *Meeting) isOccurrence(start time.Time) bool {
+	if m.RRule == "" {
+		return false
+	}
+	rule, err := m.recurrence()
+	if err != nil {
+		return false
+	}
+	return len(rule.Between(start, start, true)) > 0
+}
+
+// occurrences lists the sittings that overlap [from, to), with the series'
+// exceptions applied
+func (m *Meeting) occurrences(from, to time.Time) []Occurrence {
+	if !m.scheduled() {
+		return nil
+	}
+
+	duration := m.EndTime.Sub(*m.StartTime)
+	occurrence := func(start, end time.Time) Occurrence {
+		return Occurrence{
+			MeetingID: m.MeetingID,
+			Title:     m.Title,
+			Start:     start.UTC(),
+			End:       end.UTC(),
+			TimeZone:  m.TimeZone,
+			Recurring: m.RRule != "",
+			JoinURL:   meetingURL(m.MeetingID),
+		}
+	}
+	overlaps := func(start, end time.Time) bool {
+		return start.Before(to) && end.After(from)
+	}
+
+	if m.RRule == "" {
+		if overlaps(*m.StartTime, *m.EndTime) {
+			return []Occurrence{occurrence(*m.StartTime, *m.EndTime)}
+		}
+		return nil
+	}
+
+	rule, err := m.recurrence()
+	if err != nil {
+		return nil
+	}
+
+	exceptions := make(map[int64]OccurrenceException, len(m.Exceptions))
+	for _, exception := range m.Exceptions {
+		exceptions[exception.OriginalStart.Unix()] = exception
+	}
+
+	var result []Occurrence
+	// Start early enough to catch a sitting already under way at from
+	for _, start := range rule.Between(from.Add(-duration), to, true) {
+		if len(result) >= maxOccurrences {
+			break
+		}
+		if _, excepted := exceptions[start.Unix()]; excepted {
+			continue
+		}
+		if overlaps(start, start.Add(duration)) {
+			result = append(result, occurrence(start, start.Add(duration)))
+		}
+	}
+
+	// Moved sittings may land in range from anywhere in the series
+	for _, exception := range m.Exceptions {
+		if exception.Cancelled || exception.Start == nil || exception.End == nil {
+			continue
+		}
+		if overlaps(*exception.Start, *exception.End) {
+			moved := occurrence(*exception.Start, *exception.End)
+			originalStart := exception.OriginalStart.UTC()
+			moved.OriginalStart = &originalStart
+			result = append(result, moved)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result
+}
+
+// upcomingMeetingsHandler lists the caller's meeting occurrences between
+// ?from= and ?to= (RFC 3339), defaulting to the next 30 days
+func upcomingMeetingsHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	from, to := time.Now(), time.Time{}
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "from must be an RFC 3339 timestamp"})
+			return
+		}
+		from = parsed
+	}
+	to = from.Add(defaultUpcomingRange)
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "to must be an RFC 3339 timestamp"})
+			return
+		}
+		to = parsed
+	}
+	if !to.After(from) || to.Sub(from) > maxUpcomingRange {
+		c.JSON(400, gin.H{"error": "to must be after from and at most a year later"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := meetingRoleFilter(claims, roleInvitee)
+	filter["start_time"] = bson.M{"$lt": to}
+	cursor, err := db.Collection("meetings").Find(ctx, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch meetings"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var meetings []Meeting
+	if err = cursor.All(ctx, &meetings); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to decode meetings"})
+		return
+	}
+
+	occurrences := []Occurrence{}
+	for i := range meetings {
+		occurrences = append(occurrences, meetings[i].occurrences(from, to)...)
+	}
+	sort.Slice(occurrences, func(i, j int) bool { return occurrences[i].Start.Before(occurrences[j].Start) })
+
+	c.JSON(200, gin.H{
+		"from":        from.UTC(),
+		"to":          to.UTC(),
+		"occurrences": occurrences,
+	})
+}
+
+// occurrenceHandler cancels, moves or restores one occurrence of a series
+func occurrenceHandler(c *gin.Context) {
+	var occurrenceData struct {
+		OriginalStart time.Time  `json:"originalStart" binding:"required"`
+		Action        string     `json:"action"`
+		StartTime     *time.Time `json:"startTime"`
+		EndTime       *time.Time `json:"endTime"`
+	}
+
+	if err := c.ShouldBindJSON(&occurrenceData); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleHost)
+	if !ok {
+		return
+	}
+	if meeting.RRule == "" || !meeting.scheduled() {
+		c.JSON(400, gin.H{"error": errNotRecurring.Error()})
+		return
+	}
+	if !meeting.isOccurrence(occurrenceData.OriginalStart) {
+		c.JSON(400, gin.H{"error": errNotAnOccurrence.Error()})
+		return
+	}
+
+	originalStart := occurrenceData.OriginalStart.UTC()
+	exception := OccurrenceException{OriginalStart: originalStart}
+	switch occurrenceData.Action {
+	case "cancel":
+		exception.Cancelled = true
+	case "move":
+		if occurrenceData.StartTime == nil || occurrenceData.EndTime == nil {
+			c.JSON(400, gin.H{"error": errScheduleIncomplete.Error()})
+			return
+		}
+		if !occurrenceData.EndTime.After(*occurrenceData.StartTime) {
+			c.JSON(400, gin.H{"error": errScheduleOrder.Error()})
+			return
+		}
+		start, end := occurrenceData.StartTime.UTC(), occurrenceData.EndTime.UTC()
+		exception.Start = &start
+		exception.End = &end
+	case "restore":
+	default:
+		c.JSON(400, gin.H{"error": "action must be cancel, move or restore"})
+		return
+	}
+
+	exceptions := []OccurrenceException{}
+	for _, existing := range meeting.Exceptions {
+		if !existing.OriginalStart.Equal(originalStart) {
+			exceptions = append(exceptions, existing)
+		}
+	}
+	if occurrenceData.Action != "restore" {
+		exceptions = append(exceptions, exception)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("meetings").UpdateOne(
+		ctx,
+		bson.M{"meeting_id": meeting.MeetingID},
+		bson.M{"$set": bson.M{"exceptions": exceptions}},
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to update occurrence"})
+		return
+	}
+	meeting.Exceptions = exceptions
+
+	c.JSON(200, gin.H{
+		"message": "Occurrence updated",
+		"meeting": meeting,
+	})
+}
+
+// icsHandler serves a scheduled meeting as an iCalendar file
+func icsHandler(c *gin.Context) {
+	meeting, ok := authorizeMeeting(c, c.Param("id"), roleInvitee)
+	if !ok {
+		return
+	}
+	if !meeting.scheduled() {
+		c.JSON(400, gin.H{"error": "Meeting is not scheduled"})
+		return
+	}
+
+	var organizer User
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": meeting.CreatedBy}).Decode(&organizer); err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(500, gin.H{"error": "Failed to find meeting organizer"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meeting.MeetingID+".ics"))
+	c.Data(200, "text/calendar; charset=utf-8", []byte(meetingICS(meeting, &organizer, time.Now())))
+}
+
+// meetingICS renders a meeting as an RFC 5545 calendar. Moved occurrences
+// become overriding VEVENTs and cancelled ones EXDATEs.
+func meetingICS(meeting *Meeting, organizer *User, now time.Time) string {
+	loc := meeting.location()
+	w := &icsWriter{}
+
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//Delta Meet//Meetings//EN")
+	w.line("CALSCALE", "GREGORIAN")
+	if loc != time.UTC {
+		w.timezone(loc, meeting.StartTime.Year(), meeting.timezoneEndYear())
+	}
+
+	uid := meeting.MeetingID + "@delta-meet"
+	event := func(start, end time.Time, recurrenceID *time.Time) {
+		w.line("BEGIN", "VEVENT")
+		w.line("UID", uid)
+		w.line("DTSTAMP", now.UTC().Format(icsDateTime)+"Z")
+		if recurrenceID != nil {
+			w.dateTime("RECURRENCE-ID", *recurrenceID, loc)
+		}
+		w.dateTime("DTSTART", start, loc)
+		w.dateTime("DTEND", end, loc)
+		if recurrenceID == nil && meeting.RRule != "" {
+			w.line("RRULE", meeting.RRule)
+			for _, exception := range meeting.Exceptions {
+				if exception.Cancelled {
+					w.dateTime("EXDATE", exception.OriginalStart, loc)
+				}
+			}
+		}
+
+		title := meeting.Title
+		if title == "" {
+			title = "Delta Meet meeting"
+		}
+		joinURL := meetingURL(meeting.MeetingID)
+		w.line("SUMMARY", icsEscape(title))
+		w.line("DESCRIPTION", icsEscape("Join the meeting: "+joinURL))
+		w.line("LOCATION", icsEscape(joinURL))
+		w.line("URL", joinURL)
+		if organizer.Email != "" {
+			w.line("ORGANIZER;CN="+icsParam(organizer.Name), "mailto:"+organizer.Email)
+		}
+		for _, invitee := range meeting.Invitees {
+			w.line("ATTENDEE;ROLE=REQ-PARTICIPANT;RSVP=TRUE", "mailto:"+invitee)
+		}
+		w.line("END", "VEVENT")
+	}
+
+	event(*meeting.StartTime, *meeting.EndTime, nil)
+	for _, exception := range meeting.Exceptions {
+		if !exception.Cancelled && exception.Start != nil && exception.End != nil {
+			originalStart := exception.OriginalStart
+			event(*exception.Start, *exception.End, &originalStart)
+		}
+	}
+
+	w.line("END", "VCALENDAR")
+	return w.String()
+}
+
+// timezoneEndYear is the last year the calendar's VTIMEZONE has to describe
+func (m *Meeting) timezoneEndYear() int {
+	last := m.EndTime.Year()
+	if m.RRule == "" {
+		return last
+	}
+	last = m.StartTime.Year() + icsTimezoneYears
+	// A series with COUNT or UNTIL ends on its final occurrence
+	if option, err := rrule.StrToROption(m.RRule); err == nil && (option.Count > 0 || !option.Until.IsZero()) {
+		if rule, err := m.recurrence(); err == nil {
+			// Walk no further than the years covered anyway, and no more than
+			// maxRRuleCount occurrences for rules stored before it was enforced
+			final, next := 0, rule.Iterator()
+			for i := 0; i <= maxRRuleCount; i++ {
+				start, ok := next()
+				if !ok {
+					// The series ended, on or before the year covered anyway
+					if final > 0 {
+						last = final
+					}
+					break
+				}
+				if final = start.Year(); final >= last {
+					break
+				}
+			}
+		}
+	}
+	for _, exception := range m.Exceptions {
+		if exception.End != nil && exception.End.Year() > last {
+			last = exception.End.Year()
+		}
+	}
+	return last
+}
+
+// icsWriter builds iCalendar content lines, folded at 75 octets
+type icsWriter struct {
+	builder strings.Builder
+}
+
+func (w *icsWriter) line(name, value string) {
+	content := name + ":" + value
+	// Continuation lines start with a space, which counts towards the 75
+	limit := 75
+	for len(content) > limit {
+		cut := limit
+		// Never split a UTF-8 sequence across lines
+		for cut > 0 && content[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.builder.WriteString(content[:cut] + "\r\n ")
+		content = content[cut:]
+		limit = 74
+	}
+	w.builder.WriteString(content + "\r\n")
+}
+
+// dateTime writes a DATE-TIME property in loc, or in UTC when loc is UTC
+func (w *icsWriter) dateTime(name string, t time.Time, loc *time.Location) {
+	if loc == time.UTC {
+		w.line(name, t.UTC().Format(icsDateTime)+"Z")
+		return
+	}
+	w.line(name+";TZID="+loc.String(), t.In(loc).Format(icsDateTime))
+}
+
+// timezone describes loc's offsets from the start of fromYear to the end
+// of toYear, one observance per transition
+func (w *icsWriter) timezone(loc *time.Location, fromYear, toYear int) {
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", loc.String())
+
+	observance := func(at time.Time, offsetFrom int) {
+		name, offsetTo := at.Zone()
+		kind := "STANDARD"
+		if at.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		w.line("BEGIN", kind)
+		// DTSTART is the local time of the change, in the offset it changes from
+		w.line("DTSTART", at.UTC().Add(time.Duration(offsetFrom)*time.Second).Format(icsDateTime))
+		w.line("TZOFFSETFROM", icsOffset(offsetFrom))
+		w.line("TZOFFSETTO", icsOffset(offsetTo))
+		w.line("TZNAME", icsEscape(name))
+		w.line("END", kind)
+	}
+
+	current := time.Date(fromYear, time.January, 1, 0, 0, 0, 0, loc)
+	end := time.Date(toYear+1, time.January, 1, 0, 0, 0, 0, loc)
+	_, offset := current.Zone()
+	observance(current, offset)
+
+	for {
+		_, next := current.ZoneBounds()
+		if next.IsZero() || !next.Before(end) {
+			break
+		}
+		_, previousOffset := current.Zone()
+		current = next.In(loc)
+		observance(current, previousOffset)
+	}
+
+	w.line("END", "VTIMEZONE")
+}
+
+func (w *icsWriter) String() string {
+	return w.builder.String()
+}
+
+func icsOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds%3600/60)
+}
+
+// icsEscape escapes a TEXT value
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// icsParam quotes a parameter value, which may not contain double quotes
+func icsParam(value string) string {
+	return `"` + strings.NewReplacer(`"`, "'", "\r", "", "\n", " ").Replace(value) + `"`
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"html"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+	maxSearchQueryLength  = 256
+	snippetContext        = 60 // runes either side of the first match
+)
+
+// SearchResult is one chat message matching a search
+type SearchResult struct {
+	Message ChatMessage `json:"message"`
+	Score   float64     `json:"score"`
+	// HTML-escaped text around the first match, matches wrapped in <mark>
+	Snippet string `json:"snippet"`
+	// Cursor for getChatMessagesHandler, and a link to the history page
+	// that starts at the message
+	Cursor string `json:"cursor"`
+	Link   string `json:"link"`
+}
+
+// searchTerms splits a text search into the words to highlight, dropping
+// negated words
+func searchTerms(query string) []string {
+	var terms []string
+	for _, field := range strings.FieldsFunc(query, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"'
+	}) {
+		if strings.HasPrefix(field, "-") {
+			continue
+		}
+		field = strings.TrimFunc(strings.ToLower(field), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		// Single letters would light up half the snippet
+		if utf8.RuneCountInString(field) < 2 {
+			continue
+		}
+		// The text index stems words, so "links" finds "link". Highlighting
+		// the common stem catches most of those matches.
+		for _, suffix := range []string{"ing", "ed", "es", "s"} {
+			if len(field) > len(suffix)+2 && strings.HasSuffix(field, suffix) {
+				field = strings.TrimSuffix(field, suffix)
+				break
+			}
+		}
+		terms = append(terms, field)
+	}
+	// Longest first so the pattern prefers the longer of overlapping terms
+	sort.Slice(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+	return terms
+}
+
+// highlight cuts the text around the first match of any term and marks
+// every match in the cut. The text is HTML-escaped.
+func highlight(text string, terms []string) string {
+	runes := []rune(text)
+	if len(terms) == 0 {
+		return html.EscapeString(string(runes[:min(len(runes), 2*snippetContext)]))
+	}
+
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	pattern := regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+
+	start, end := 0, min(len(runes), 2*snippetContext)
+	if match := pattern.FindStringIndex(text); match != nil {
+		first := len([]rune(text[:match[0]]))
+		start = max(0, first-snippetContext)
+		end = min(len(runes), first+snippetContext)
+	}
+	cut := string(runes[start:end])
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	last := 0
+	for _, match := range pattern.FindAllStringIndex(cut, -1) {
+		b.WriteString(html.EscapeString(cut[last:match[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(cut[match[0]:match[1]]))
+		b.WriteString("</mark>")
+		last = match[1]
+	}
+	b.WriteString(html.EscapeString(cut[last:]))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// historyLink points at the page of a meeting's chat that starts with the
+// message. Stored timestamps are in milliseconds, so a millisecond earlier
+// is before the message but after anything older.
+func historyLink(message *ChatMessage) string {
+	query := url.Values{}
+	query.Set("after", message.Timestamp.Add(-time.Millisecond).UTC().Format(time.RFC3339Nano))
+	if message.ParentID != nil {
+		query.Set("thread", message.ParentID.Hex())
+	}
+	return "/api/chat/" + url.PathEscape(message.MeetingID) + "?" + query.Encode()
+}
+
+// searchChatHandler serves GET /chat/search?q=, searching the chat of every
+// meeting the caller took part in. ?meeting=, ?author= (a user ID), ?from=
+// and ?to= (RFC 3339) narrow the search. Results are best match first and
+// page with ?limit= and ?offset=.
+func searchChatHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(400, gin.H{"error": "q is required"})
+		return
+	}
+	if len(query) > maxSearchQueryLength {
+		c.JSON(400, gin.H{"error": "q is too long"})
+		return
+	}
+
+	limit, offset := defaultSearchPageSize, 0
+	for param, target := range map[string]*int{"limit": &limit, "offset": &offset} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			c.JSON(400, gin.H{"error": param + " must be a non-negative number"})
+			return
+		}
+		*target = parsed
+	}
+	if limit == 0 {
+		c.JSON(400, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+	if limit > maxSearchPageSize {
+		limit = maxSearchPageSize
+	}
+
+	timestamp := bson.M{}
+	for param, operator := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": param + " must be an RFC 3339 timestamp"})
+			return
+		}
+		timestamp[operator] = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var meetingIDs []string
+	if meetingID := c.Query("meeting"); meetingID != "" {
+		meeting, ok := authorizeMeeting(c, meetingID, roleParticipant)
+		if !ok {
+			return
+		}
+		meetingIDs = []string{meeting.MeetingID}
+	} else {
+		cursor, err := db.Collection("meetings").Find(
+			ctx,
+			meetingRoleFilter(claims, roleParticipant),
+			options.Find().SetProjection(bson.M{"meeting_id": 1}),
+		)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch meetings"})
+			return
+		}
+		var meetings []Meeting
+		if err := cursor.All(ctx, &meetings); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to decode meetings"})
+			return
+		}
+		for _, meeting := range meetings {
+			meetingIDs = append(meetingIDs, meeting.MeetingID)
+		}
+	}
+
+	if len(meetingIDs) == 0 {
+		c.JSON(200, gin.H{"results": []SearchResult{}, "count": 0, "hasMore": false})
+		return
+	}
+
+	filter := bson.M{
+		"$text":      bson.M{"$search": query},
+		"meeting_id": bson.M{"$in": meetingIDs},
+		"deleted":    bson.M{"$ne": true},
+		"$and":       []bson.M{visibleChatFilter(claims.UserID)},
+	}
+	if author := c.Query("author"); author != "" {
+		filter["user_id"] = author
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	cursor, err := db.Collection("chat_messages").Find(
+		ctx,
+		filter,
+		options.Find().
+			SetProjection(bson.M{"score": score}).
+			SetSort(bson.D{{Key: "score", Value: score}, {Key: "timestamp", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit+1)),
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to search messages"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var matches []struct {
+		ChatMessage `bson:",inline"`
+		Score       float64 `bson:"score"`
+	}
+	if err := cursor.All(ctx, &matches); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to decode messages"})
+		return
+	}
+
+	hasMore := len(matches) > limit
+	if hasMore {
+		matches = matches[:limit]
+	}
+
+	terms := searchTerms(query)
+	results := make([]SearchResult, 0, len(matches))
+	for _, match := range matches {
+		message := match.ChatMessage
+		message.countReactions()
+		results = append(results, SearchResult{
+			Message: message,
+			Score:   match.Score,
+			Snippet: highlight(message.Message, terms),
+			Cursor:  message.ID.Hex(),
+			Link:    historyLink(&message),
+		})
+	}
+
+	response := gin.H{
+		"results": results,
+		"count":   len(results),
+		"hasMore": hasMore,
+	}
+	if hasMore {
+		response["nextOffset"] = offset + limit
+	}
+	c.JSON(200, response)
+}
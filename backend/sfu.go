@@ -0,0 +1,544 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Media modes a meeting can run in
+const (
+	mediaModeMesh = "mesh" // peers exchange media directly, the server only relays signaling
+	mediaModeSFU  = "sfu"  // every peer publishes to the server, which forwards to the others
+)
+
+const (
+	keyFrameInterval   = 3 * time.Second
+	maxSyncAttempts    = 25
+	rtpBufferSize      = 1500
+	resyncRetryBackoff = 3 * time.Second
+)
+
+// SignalPayload is the data of a signaling message exchanged with the SFU.
+// Clients send "join" to publish, then "answer" and "candidate" messages;
+// the server sends "offer" and "candidate" messages.
+type SignalPayload struct {
+	Type      string                   `json:"type"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+}
+
+// SFU forwards RTP from each publishing peer to every other peer in the same room
+type SFU struct {
+	api       *webrtc.API
+	config    webrtc.Configuration
+	rooms     map[string]*sfuRoom
+	mutex     sync.Mutex
+	sinks     map[string]trackSink
+	sinkMutex sync.RWMutex
+	done      chan struct{}
+}
+
+// trackSink receives a copy of every RTP packet forwarded in a meeting
+type trackSink interface {
+	WriteRTP(userID string, track *webrtc.TrackRemote, packet *rtp.Packet)
+}
+
+type sfuRoom struct {
+	peers  map[string]*sfuPeer
+	tracks map[string]*sfuTrack
+	mutex  sync.Mutex
+}
+
+type sfuPeer struct {
+	userID  string
+	owner   *Connection // the socket that joined, so a stale one cannot leave for it
+	pc      *webrtc.PeerConnection
+	signal  func(SignalPayload)
+	offered bool // guarded by the room mutex
+}
+
+type sfuTrack struct {
+	owner string
+	local *webrtc.TrackLocalStaticRTP
+}
+
+// newSFU builds an SFU with the default codecs and interceptors. publicIP,
+// when set, is advertised in host candidates for servers behind 1:1 NAT.
+func newSFU(config webrtc.Configuration, publicIP string) (*SFU, error) {
+	settingEngine := webrtc.SettingEngine{}
+	if publicIP != "" {
+		if net.ParseIP(publicIP) == nil {
+			return nil, fmt.Errorf("invalid public IP %q", publicIP)
+		}
+		settingEngine.SetNAT1To1IPs([]string{publicIP}, webrtc.ICECandidateTypeHost)
+	}
+	return newSFUWithSettings(config, settingEngine)
+}
+
+// newSFUWithSettings builds an SFU whose ICE agents follow settingEngine
+func newSFUWithSettings(config webrtc.Configuration, settingEngine webrtc.SettingEngine) (*SFU, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+
+	s := &SFU{
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(mediaEngine),
+			webrtc.WithInterceptorRegistry(registry),
+			webrtc.WithSettingEngine(settingEngine),
+		),
+		config: config,
+		rooms:  make(map[string]*sfuRoom),
+		sinks:  make(map[string]trackSink),
+		done:   make(chan struct{}),
+	}
+	go s.keyFrameLoop()
+	return s, nil
+}
+
+// Join creates the server side PeerConnection for a user joining over owner
+// and sends them an offer through signal. An existing peer for the same user
+// is replaced.
+func (s *SFU) Join(meetingID, userID string, owner *Connection, signal func(SignalPayload)) error {
+	pc, err := s.api.NewPeerConnection(s.config)
+	if err != nil {
+		return err
+	}
+
+	// Accept one audio and one video track from the publisher
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			pc.Close()
+			return err
+		}
+	}
+
+	peer := &sfuPeer{userID: userID, owner: owner, pc: pc, signal: signal}
+
+	// The room is found and the peer added under one lock, so a Leave
+	// emptying the room cannot delete it in between
+	s.mutex.Lock()
+	room := s.roomLocked(meetingID)
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		init := candidate.ToJSON()
+
+		// Offers are sent under the room lock, so taking it here keeps a
+		// candidate from overtaking the offer it belongs to
+		room.mutex.Lock()
+		defer room.mutex.Unlock()
+		signal(SignalPayload{Type: "candidate", Candidate: &init})
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed:
+			pc.Close()
+		case webrtc.PeerConnectionStateClosed:
+			room.signalPeers()
+		}
+	})
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		room.forward(peer, remote, func() trackSink { return s.sink(meetingID) })
+	})
+
+	previous := room.addPeer(peer)
+	s.mutex.Unlock()
+	if previous != nil {
+		previous.pc.Close()
+	}
+
+	log.Printf("SFU: user %s joined meeting %s", userID, meetingID)
+	room.signalPeers()
+	return nil
+}
+
+// HandleSignal applies an answer or ICE candidate sent by a client
+func (s *SFU) HandleSignal(meetingID, userID string, payload SignalPayload) error {
+	room, peer := s.peer(meetingID, userID)
+	if peer == nil {
+		return errors.New("not joined to the media server")
+	}
+
+	switch payload.Type {
+	case "answer":
+		if err := peer.pc.SetRemoteDescription(webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  payload.SDP,
+		}); err != nil {
+			return err
+		}
+		// Tracks may have changed while this peer was mid-negotiation
+		room.signalPeers()
+		return nil
+	case "candidate":
+		if payload.Candidate == nil {
+			return errors.New("candidate message has no candidate")
+		}
+		return peer.pc.AddICECandidate(*payload.Candidate)
+	default:
+		return fmt.Errorf("unknown signaling type %q", payload.Type)
+	}
+}
+
+// Leave closes the PeerConnection owner joined with and stops forwarding its
+// tracks. It does nothing if the user has since joined over another socket.
+func (s *SFU) Leave(meetingID, userID string, owner *Connection) {
+	s.mutex.Lock()
+	room, exists := s.rooms[meetingID]
+	if !exists {
+		s.mutex.Unlock()
+		return
+	}
+	peer := room.removePeer(userID, owner)
+	if room.isEmpty() {
+		delete(s.rooms, meetingID)
+	}
+	s.mutex.Unlock()
+
+	if peer != nil {
+		peer.pc.Close()
+		log.Printf("SFU: user %s left meeting %s", userID, meetingID)
+	}
+	room.signalPeers()
+}
+
+// Close tears down every room and stops the keyframe loop
+func (s *SFU) Close() {
+	s.mutex.Lock()
+	rooms := s.rooms
+	s.rooms = make(map[string]*sfuRoom)
+	s.mutex.Unlock()
+
+	close(s.done)
+	for _, room := range rooms {
+		room.mutex.Lock()
+		for _, peer := range room.peers {
+			peer.pc.Close()
+		}
+		room.mutex.Unlock()
+	}
+}
+
+// SetSink starts copying a meeting's media to sink, replacing any previous one
+func (s *SFU) SetSink(meetingID string, sink trackSink) {
+	s.sinkMutex.Lock()
+	defer s.sinkMutex.Unlock()
+	s.sinks[meetingID] = sink
+}
+
+// ClearSink stops copying a meeting's media
+func (s *SFU) ClearSink(meetingID string) {
+	s.sinkMutex.Lock()
+	defer s.sinkMutex.Unlock()
+	delete(s.sinks, meetingID)
+}
+
+func (s *SFU) sink(meetingID string) trackSink {
+	s.sinkMutex.RLock()
+	defer s.sinkMutex.RUnlock()
+	return s.sinks[meetingID]
+}
+
+// roomLocked returns a meeting's room, creating it if need be. Caller must
+// hold s.mutex.
+func (s *SFU) roomLocked(meetingID string) *sfuRoom {
+	room, exists := s.rooms[meetingID]
+	if !exists {
+		room = &sfuRoom{
+			peers:  make(map[string]*sfuPeer),
+			tracks: make(map[string]*sfuTrack),
+		}
+		s.rooms[meetingID] = room
+	}
+	return room
+}
+
+func (s *SFU) peer(meetingID, userID string) (*sfuRoom, *sfuPeer) {
+	s.mutex.Lock()
+	room, exists := s.rooms[meetingID]
+	s.mutex.Unlock()
+	if !exists {
+		return nil, nil
+	}
+
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	return room, room.peers[userID]
+}
+
+// keyFrameLoop periodically asks publishers for keyframes so that
+// subscribers joining mid-stream can start decoding quickly
+func (s *SFU) keyFrameLoop() {
+	ticker := time.NewTicker(keyFrameInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			rooms := make([]*sfuRoom, 0, len(s.rooms))
+			for _, room := range s.rooms {
+				rooms = append(rooms, room)
+			}
+			s.mutex.Unlock()
+
+			for _, room := range rooms {
+				room.dispatchKeyFrames()
+			}
+		}
+	}
+}
+
+func (r *sfuRoom) addPeer(peer *sfuPeer) *sfuPeer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous := r.peers[peer.userID]
+	r.peers[peer.userID] = peer
+	return previous
+}
+
+// removePeer takes out the peer userID joined with over owner, if that is
+// still their current one
+func (r *sfuRoom) removePeer(userID string, owner *Connection) *sfuPeer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	peer, exists := r.peers[userID]
+	if !exists || peer.owner != owner {
+		return nil
+	}
+	delete(r.peers, userID)
+	for key, track := range r.tracks {
+		if track.owner == userID {
+			delete(r.tracks, key)
+		}
+	}
+	return peer
+}
+
+func (r *sfuRoom) isEmpty() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.peers) == 0
+}
+
+// forward republishes a remote track to the room until the publisher goes
+// away, copying each packet to the meeting's sink if one is set
+func (r *sfuRoom) forward(owner *sfuPeer, remote *webrtc.TrackRemote, sink func() trackSink) {
+	// The stream ID is the owner's user ID so subscribers can tell whose media it is
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), owner.userID)
+	if err != nil {
+		log.Printf("SFU: failed to create local track for user %s: %v", owner.userID, err)
+		return
+	}
+
+	key := trackKey(local)
+	r.mutex.Lock()
+	if r.peers[owner.userID] != owner {
+		// The publisher was replaced or left before the track arrived
+		r.mutex.Unlock()
+		return
+	}
+	r.tracks[key] = &sfuTrack{owner: owner.userID, local: local}
+	r.mutex.Unlock()
+	r.signalPeers()
+
+	defer func() {
+		r.mutex.Lock()
+		if current, ok := r.tracks[key]; ok && current.local == local {
+			delete(r.tracks, key)
+		}
+		r.mutex.Unlock()
+		r.signalPeers()
+	}()
+
+	buf := make([]byte, rtpBufferSize)
+	packet := &rtp.Packet{}
+	for {
+		n, _, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+		if err := packet.Unmarshal(buf[:n]); err != nil {
+			log.Printf("SFU: dropping malformed RTP packet from user %s: %v", owner.userID, err)
+			continue
+		}
+
+		// Header extension IDs are negotiated per PeerConnection, so strip them
+		packet.Extension = false
+		packet.Extensions = nil
+
+		if s := sink(); s != nil {
+			s.WriteRTP(owner.userID, remote, packet)
+		}
+
+		if err := local.WriteRTP(packet); err != nil {
+			return
+		}
+	}
+}
+
+// signalPeers brings every PeerConnection's senders in line with the room's
+// tracks and sends a fresh offer to each peer that can take one right now
+func (r *sfuRoom) signalPeers() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if attempt == maxSyncAttempts {
+			// Give the peers a moment to settle, then try again
+			go func() {
+				time.Sleep(resyncRetryBackoff)
+				r.signalPeers()
+			}()
+			return
+		}
+		if !r.attemptSync() {
+			return
+		}
+	}
+}
+
+// attemptSync reports whether the sync must be retried. Caller must hold r.mutex.
+func (r *sfuRoom) attemptSync() bool {
+	for userID, peer := range r.peers {
+		if peer.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			delete(r.peers, userID)
+			return true
+		}
+
+		// A peer awaiting an answer is synced again once the answer arrives
+		if peer.pc.SignalingState() != webrtc.SignalingStateStable {
+			continue
+		}
+
+		changed := !peer.offered
+		existing := make(map[string]bool)
+		for _, sender := range peer.pc.GetSenders() {
+			track := sender.Track()
+			if track == nil {
+				continue
+			}
+			key := trackKey(track)
+			existing[key] = true
+			if _, ok := r.tracks[key]; !ok {
+				if err := peer.pc.RemoveTrack(sender); err != nil {
+					return true
+				}
+				changed = true
+			}
+		}
+
+		for key, track := range r.tracks {
+			if track.owner == userID || existing[key] {
+				continue
+			}
+			if _, err := peer.pc.AddTrack(track.local); err != nil {
+				return true
+			}
+			changed = true
+		}
+
+		// Only renegotiate when there is something new to say
+		if !changed {
+			continue
+		}
+
+		offer, err := peer.pc.CreateOffer(nil)
+		if err != nil {
+			return true
+		}
+		if err := peer.pc.SetLocalDescription(offer); err != nil {
+			return true
+		}
+		peer.offered = true
+		peer.signal(SignalPayload{Type: "offer", SDP: offer.SDP})
+	}
+	return false
+}
+
+func (r *sfuRoom) dispatchKeyFrames() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, peer := range r.peers {
+		for _, receiver := range peer.pc.GetReceivers() {
+			track := receiver.Track()
+			if track == nil {
+				continue
+			}
+			_ = peer.pc.WriteRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+			})
+		}
+	}
+}
+
+func trackKey(track webrtc.TrackLocal) string {
+	return track.StreamID() + "/" + track.ID()
+}
+
+// handleSFUSignaling negotiates the connection's media with the server
+// instead of relaying it to another peer
+func (c *Connection) handleSFUSignaling(msg WebSocketMessage) {
+	var payload SignalPayload
+	if err := decodeData(msg.Data, &payload); err != nil {
+		c.sendError("Invalid signaling payload")
+		return
+	}
+
+	var err error
+	if payload.Type == "join" {
+		err = mediaServer.Join(c.meetingID, c.userID, c, c.sendSignal)
+	} else {
+		err = mediaServer.HandleSignal(c.meetingID, c.userID, payload)
+	}
+	if err != nil {
+		log.Printf("SFU signaling error for user %s in meeting %s: %v", c.userID, c.meetingID, err)
+		c.sendError(fmt.Sprintf("Signaling failed: %v", err))
+	}
+}
+
+func (c *Connection) sendSignal(payload SignalPayload) {
+	c.sendMessage(WebSocketMessage{
+		Type:      "signaling",
+		Data:      payload,
+		MeetingID: c.meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// decodeData converts the loosely typed Data of a WebSocketMessage into v
+func decodeData(data interface{}, v interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
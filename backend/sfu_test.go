@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// loopbackSettings keeps ICE on 127.0.0.1 so the test needs no network
+func loopbackSettings() webrtc.SettingEngine {
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetIncludeLoopbackCandidate(true)
+	settingEngine.SetIPFilter(func(ip net.IP) bool { return ip.IsLoopback() })
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	return settingEngine
+}
+
+// testClient is a browser stand-in that answers whatever the SFU offers it
+type testClient struct {
+	pc      *webrtc.PeerConnection
+	owner   *Connection
+	signals chan SignalPayload
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newTestClient(t *testing.T) *testClient {
+	t.Helper()
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(loopbackSettings()))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &testClient{pc: pc, owner: &Connection{}, signals: make(chan SignalPayload, 64), done: make(chan struct{})}
+	t.Cleanup(func() {
+		close(client.done)
+		client.wg.Wait()
+		pc.Close()
+	})
+	return client
+}
+
+// signal is what the SFU calls to reach the client, under the room lock, so
+// it is buffered and gives up once the test is over
+func (c *testClient) signal(payload SignalPayload) {
+	select {
+	case c.signals <- payload:
+	case <-c.done:
+	}
+}
+
+// join publishes the client to the SFU and negotiates until the test ends.
+// Answers carry every candidate, so none can reach the SFU before its answer.
+func (c *testClient) join(t *testing.T, s *SFU, meetingID, userID string) {
+	t.Helper()
+
+	if err := s.Join(meetingID, userID, c.owner, c.signal); err != nil {
+		t.Fatal(err)
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			var payload SignalPayload
+			select {
+			case payload = <-c.signals:
+			case <-c.done:
+				return
+			}
+
+			switch payload.Type {
+			case "offer":
+				if err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: payload.SDP}); err != nil {
+					t.Errorf("%s: set offer: %v", userID, err)
+					return
+				}
+				answer, err := c.pc.CreateAnswer(nil)
+				if err != nil {
+					t.Errorf("%s: create answer: %v", userID, err)
+					return
+				}
+				gathered := webrtc.GatheringCompletePromise(c.pc)
+				if err := c.pc.SetLocalDescription(answer); err != nil {
+					t.Errorf("%s: set answer: %v", userID, err)
+					return
+				}
+				<-gathered
+				if err := s.HandleSignal(meetingID, userID, SignalPayload{Type: "answer", SDP: c.pc.LocalDescription().SDP}); err != nil {
+					t.Errorf("%s: send answer: %v", userID, err)
+					return
+				}
+			case "candidate":
+				if err := c.pc.AddICECandidate(*payload.Candidate); err != nil {
+					t.Errorf("%s: add candidate: %v", userID, err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func TestSFUForwardsPublishedTrack(t *testing.T) {
+	s, err := newSFUWithSettings(webrtc.Configuration{}, loopbackSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered first so it runs after the clients have stopped negotiating
+	t.Cleanup(s.Close)
+
+	const meetingID = "abc-defg-hij"
+	payload := []byte{0x10, 0xde, 0xad, 0xbe, 0xef}
+
+	publisher := newTestClient(t)
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "publisher-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publisher.pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	type received struct {
+		streamID string
+		packet   *rtp.Packet
+	}
+	packets := make(chan received, 1)
+	subscriber := newTestClient(t)
+	subscriber.pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			packet, _, err := remote.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case packets <- received{streamID: remote.StreamID(), packet: packet}:
+			default:
+			}
+		}
+	})
+
+	publisher.join(t, s, meetingID, "alice")
+	subscriber.join(t, s, meetingID, "bob")
+
+	// Keep sending until the subscriber is connected, as a browser would
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for sequence := uint16(0); ; sequence++ {
+			select {
+			case <-publisher.done:
+				return
+			case <-ticker.C:
+			}
+			if err := track.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: sequence, Timestamp: uint32(sequence) * 3000, Marker: true},
+				Payload: payload,
+			}); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case got := <-packets:
+		if got.streamID != "alice" {
+			t.Errorf("forwarded stream ID = %q, want the publisher's user ID %q", got.streamID, "alice")
+		}
+		if !bytes.Equal(got.packet.Payload, payload) {
+			t.Errorf("forwarded payload = %x, want %x", got.packet.Payload, payload)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("subscriber received no forwarded RTP")
+	}
+}
+
+func TestSFULeaveIgnoresReplacedConnection(t *testing.T) {
+	s, err := newSFUWithSettings(webrtc.Configuration{}, loopbackSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	const meetingID = "abc-defg-hij"
+	discard := func(SignalPayload) {}
+	stale, current := &Connection{}, &Connection{}
+
+	if err := s.Join(meetingID, "alice", stale, discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Join(meetingID, "alice", current, discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old socket's leave arrives after the user reconnected
+	s.Leave(meetingID, "alice", stale)
+	if _, peer := s.peer(meetingID, "alice"); peer == nil || peer.owner != current {
+		t.Fatal("a stale leave removed the user's current peer")
+	}
+
+	s.Leave(meetingID, "alice", current)
+	if room, _ := s.peer(meetingID, "alice"); room != nil {
+		t.Error("the room outlived its last peer")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultTURNPort          = 3478
+	defaultTURNRealm         = "delta-meet"
+	defaultTURNCredentialTTL = 12 * time.Hour
+	defaultSTUNURL           = "stun:stun.l.google.com:19302"
+)
+
+// TURNSettings configures the embedded TURN/STUN server. The server only
+// runs when a shared secret is set.
+type TURNSettings struct {
+	PublicIP      net.IP
+	Host          string // advertised in ICE server URLs, defaults to PublicIP
+	Port          int
+	Realm         string
+	Secret        string
+	CredentialTTL time.Duration
+	RelayPortMin  uint16
+	RelayPortMax  uint16
+	FallbackSTUN  []string // returned to clients when the server is disabled
+}
+
+var turnSettings TURNSettings
+
+func (s TURNSettings) enabled() bool {
+	return s.Secret != ""
+}
+
+// loadTURNSettings reads the TURN_* variables from the environment
+func loadTURNSettings() (TURNSettings, error) {
+	settings := TURNSettings{
+		Host:          os.Getenv("TURN_HOST"),
+		Port:          defaultTURNPort,
+		Realm:         os.Getenv("TURN_REALM"),
+		Secret:        os.Getenv("TURN_SECRET"),
+		CredentialTTL: defaultTURNCredentialTTL,
+		FallbackSTUN:  []string{defaultSTUNURL},
+	}
+
+	if urls := os.Getenv("STUN_URLS"); urls != "" {
+		settings.FallbackSTUN = strings.Split(urls, ",")
+	}
+	if !settings.enabled() {
+		return settings, nil
+	}
+
+	if settings.Realm == "" {
+		settings.Realm = defaultTURNRealm
+	}
+
+	settings.PublicIP = net.ParseIP(os.Getenv("TURN_PUBLIC_IP"))
+	if settings.PublicIP == nil {
+		return settings, errors.New("TURN_PUBLIC_IP must be a valid IP address when TURN_SECRET is set")
+	}
+	if settings.Host == "" {
+		settings.Host = settings.PublicIP.String()
+	}
+
+	if port := os.Getenv("TURN_PORT"); port != "" {
+		parsed, err := strconv.Atoi(port)
+		if err != nil || parsed <= 0 || parsed > 65535 {
+			return settings, fmt.Errorf("invalid TURN_PORT %q", port)
+		}
+		settings.Port = parsed
+	}
+
+	if ttl := os.Getenv("TURN_CREDENTIAL_TTL"); ttl != "" {
+		parsed, err := time.ParseDuration(ttl)
+		if err != nil || parsed <= 0 {
+			return settings, fmt.Errorf("invalid TURN_CREDENTIAL_TTL %q", ttl)
+		}
+		settings.CredentialTTL = parsed
+	}
+
+	minPort, maxPort := os.Getenv("TURN_RELAY_PORT_MIN"), os.Getenv("TURN_RELAY_PORT_MAX")
+	if minPort != "" || maxPort != "" {
+		parsedMin, errMin := strconv.ParseUint(minPort, 10, 16)
+		parsedMax, errMax := strconv.ParseUint(maxPort, 10, 16)
+		if errMin != nil || errMax != nil || parsedMin == 0 || parsedMin > parsedMax {
+			return settings, errors.New("TURN_RELAY_PORT_MIN and TURN_RELAY_PORT_MAX must form a valid port range")
+		}
+		settings.RelayPortMin = uint16(parsedMin)
+		settings.RelayPortMax = uint16(parsedMax)
+	}
+
+	return settings, nil
+}
+
+// startTURNServer listens for TURN and STUN on UDP and TCP. Clients
+// authenticate with TURN REST API credentials from iceServersHandler.
+func startTURNServer(settings TURNSettings) (*turn.Server, error) {
+	address := fmt.Sprintf("0.0.0.0:%d", settings.Port)
+
+	udpListener, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP %s: %w", address, err)
+	}
+
+	tcpListener, err := net.Listen("tcp4", address)
+	if err != nil {
+		udpListener.Close()
+		return nil, fmt.Errorf("failed to listen on TCP %s: %w", address, err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       settings.Realm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(settings.Secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: relayAddressGenerator(settings),
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: relayAddressGenerator(settings),
+		}},
+	})
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		return nil, err
+	}
+
+	log.Printf("TURN server listening on %s (realm %s, relay %s)", address, settings.Realm, settings.PublicIP)
+	return server, nil
+}
+
+func relayAddressGenerator(settings TURNSettings) turn.RelayAddressGenerator {
+	if settings.RelayPortMin != 0 {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: settings.PublicIP,
+			Address:      "0.0.0.0",
+			MinPort:      settings.RelayPortMin,
+			MaxPort:      settings.RelayPortMax,
+		}
+	}
+	return &turn.RelayAddressGeneratorStatic{
+		RelayAddress: settings.PublicIP,
+		Address:      "0.0.0.0",
+	}
+}
+
+// iceServersHandler hands out the ICE servers a client should use, with
+// TURN credentials that expire after the configured TTL
+func iceServersHandler(c *gin.Context) {
+	claims := c.MustGet("claims").(*Claims)
+
+	if !turnSettings.enabled() {
+		c.JSON(200, gin.H{
+			"iceServers": []webrtc.ICEServer{{URLs: turnSettings.FallbackSTUN}},
+		})
+		return
+	}
+
+	// Username is "expiry:userId", password is base64(HMAC-SHA1(secret, username))
+	username, password, err := turn.GenerateLongTermTURNRESTCredentials(turnSettings.Secret, claims.UserID, turnSettings.CredentialTTL)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate TURN credentials"})
+		return
+	}
+
+	hostPort := net.JoinHostPort(turnSettings.Host, strconv.Itoa(turnSettings.Port))
+	c.JSON(200, gin.H{
+		"iceServers": []webrtc.ICEServer{
+			{URLs: []string{"stun:" + hostPort}},
+			{
+				URLs: []string{
+					"turn:" + hostPort + "?transport=udp",
+					"turn:" + hostPort + "?transport=tcp",
+				},
+				Username:   username,
+				Credential: password,
+			},
+		},
+		"ttl": int(turnSettings.CredentialTTL.Seconds()),
+	})
+}
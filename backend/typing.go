@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	// typingTimeout clears a typing indicator that has not been refreshed
+	typingTimeout = 5 * time.Second
+	// typingMinInterval is the least time between typing-start messages
+	// relayed from one connection. Clients refresh well inside typingTimeout.
+	typingMinInterval = time.Second
+)
+
+// TypingEvent starts or stops a user's typing indicator. Typing state is
+// never stored; it lives on the node the typist is connected to.
+type TypingEvent struct {
+	MeetingID string
+	UserID    string
+	UserName  string
+	Typing    bool
+}
+
+// handleTyping relays a typing change to the meeting. A refresh of an
+// indicator already showing only pushes back its expiry.
+func (h *Hub) handleTyping(event *TypingEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Only people in the meeting can type in it
+	if conn, exists := h.meetings[event.MeetingID][event.UserID]; !exists || conn.isClosed() {
+		return
+	}
+
+	if !event.Typing {
+		if h.clearTypingLocked(event.MeetingID, event.UserID) {
+			h.relayTypingLocked(event.MeetingID, event.UserID, event.UserName, false)
+		}
+		return
+	}
+
+	if timer, exists := h.typists[event.MeetingID][event.UserID]; exists {
+		timer.Reset(typingTimeout)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(typingTimeout, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		if h.typists[event.MeetingID][event.UserID] != timer {
+			return
+		}
+		h.clearTypingLocked(event.MeetingID, event.UserID)
+		h.relayTypingLocked(event.MeetingID, event.UserID, event.UserName, false)
+	})
+	if h.typists[event.MeetingID] == nil {
+		h.typists[event.MeetingID] = make(map[string]*time.Timer)
+	}
+	h.typists[event.MeetingID][event.UserID] = timer
+	h.relayTypingLocked(event.MeetingID, event.UserID, event.UserName, true)
+}
+
+// clearTypingLocked drops a user's typing indicator, reporting whether they
+// had one. Caller must hold h.mutex.
+func (h *Hub) clearTypingLocked(meetingID, userID string) bool {
+	timer, exists := h.typists[meetingID][userID]
+	if !exists {
+		return false
+	}
+	timer.Stop()
+	delete(h.typists[meetingID], userID)
+	if len(h.typists[meetingID]) == 0 {
+		delete(h.typists, meetingID)
+	}
+	return true
+}
+
+// relayTypingLocked sends typing-start or typing-stop to everyone else in
+// the meeting, on every node. Caller must hold h.mutex.
+func (h *Hub) relayTypingLocked(meetingID, userID, userName string, typing bool) {
+	eventType := "typing-stop"
+	if typing {
+		eventType = "typing-start"
+	}
+	data, err := json.Marshal(WebSocketMessage{
+		Type:      eventType,
+		UserID:    userID,
+		UserName:  userName,
+		MeetingID: meetingID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", eventType, err)
+		return
+	}
+
+	h.fanOut(meetingID, data, userID)
+	h.publish(&BackplaneEnvelope{
+		Kind:          envelopeBroadcast,
+		MeetingID:     meetingID,
+		ExcludeUserID: userID,
+		Message:       data,
+	})
+}
+
+// handleTypingMessage passes typing-start and typing-stop to the hub,
+// dropping starts that come faster than typingMinInterval
+func (c *Connection) handleTypingMessage(msg WebSocketMessage) {
+	typing := msg.Type == "typing-start"
+	if typing {
+		if time.Since(c.lastTypingStart) < typingMinInterval {
+			return
+		}
+		c.lastTypingStart = time.Now()
+	}
+
+	c.hub.typing <- &TypingEvent{
+		MeetingID: c.meetingID,
+		UserID:    c.userID,
+		UserName:  c.userName,
+		Typing:    typing,
+	}
+}
@@ -1,5 +1,6 @@
 import React, { useState, useEffect, useRef, useCallback } from 'react';
 import { User } from '../../types';
+import WebRTCService, { MeetingMessage } from '../../services/WebRTCService';
 import './ChatPanel.css';
 import IconButton from '@mui/material/IconButton';
 import CloseIcon from '@mui/icons-material/Close';
@@ -34,26 +35,23 @@ interface ChatPanelProps {
   meetingId: string;
   user: User;
   token: string;
+  // Chat rides on the meeting's one socket, which the server keeps per user
+  service: WebRTCService | null;
   onClose: () => void;
 }
 
-const ChatPanel: React.FC<ChatPanelProps> = ({ meetingId, user, token, onClose }) => {
+const ChatPanel: React.FC<ChatPanelProps> = ({ meetingId, user, token, service, onClose }) => {
   const [messages, setMessages] = useState<ChatMessage[]>([]);
   const [newMessage, setNewMessage] = useState('');
   const [loading, setLoading] = useState(false);
   const [historyLoading, setHistoryLoading] = useState(false);
   const [wsConnected, setWsConnected] = useState(false);
-  const [reconnectAttempts, setReconnectAttempts] = useState(0);
   const [showEmojiPicker, setShowEmojiPicker] = useState(false);
   const [file, setFile] = useState<File | null>(null);
   const [fileUploading, setFileUploading] = useState(false);
-  const MAX_RECONNECT_ATTEMPTS = 5;
   const messagesEndRef = useRef<HTMLDivElement>(null);
-  const wsRef = useRef<WebSocket | null>(null);
   const messageInputRef = useRef<HTMLInputElement>(null);
   const mountedRef = useRef(true);
-  const connectingRef = useRef(false);
-  const reconnectTimeoutRef = useRef<NodeJS.Timeout | null>(null);
 
   // Scroll to bottom helper
   const scrollToBottom = useCallback(() => {
@@ -110,179 +108,63 @@ const ChatPanel: React.FC<ChatPanelProps> = ({ meetingId, user, token, onClose }
     }
   }, [meetingId, token, scrollToBottom]);
 
-  // Cleanup function
-  const cleanup = useCallback(() => {
-    if (reconnectTimeoutRef.current) {
-      clearTimeout(reconnectTimeoutRef.current);
-      reconnectTimeoutRef.current = null;
-    }
-    if (wsRef.current) {
-      wsRef.current.close(1000, 'Component unmounting');
-      wsRef.current = null;
-    }
-  }, []);
-
-  // Initialize WebSocket
-  const initializeWebSocket = useCallback(() => {
-    // Don't try to reconnect if we're already connected, connecting, or exceeded max attempts
-    if (wsRef.current?.readyState === WebSocket.OPEN || 
-        connectingRef.current || 
-        reconnectAttempts >= MAX_RECONNECT_ATTEMPTS) {
-      return;
-    }
-
-    // Cleanup existing connection first
-    cleanup();
-    connectingRef.current = true;
-
-    const wsUrl = `ws://localhost:8080/api/ws?meetingId=${meetingId}&userId=${user.id}`;
-    console.log('Connecting to WebSocket:', wsUrl);
-    
-    const ws = new WebSocket(wsUrl);
-    wsRef.current = ws;
-
-    const connectionTimeout = setTimeout(() => {
-      if (ws.readyState !== WebSocket.OPEN) {
-        console.log('WebSocket connection timeout');
-        cleanup();
-        connectingRef.current = false;
-        setWsConnected(false);
-      }
-    }, 5000);
-
-    ws.onopen = () => {
-      clearTimeout(connectionTimeout);
-      console.log('WebSocket connected');
-      setWsConnected(true);
-      setReconnectAttempts(0);
-      connectingRef.current = false;
-      
-      // Send authentication message
-      const authMessage = {
-        type: 'auth',
-        token,
-        meetingId,
-        userId: user.id,
-        userName: user.name,
-        userEmail: user.email
+  // Handle chat frames from the meeting socket
+  const handleMessage = useCallback((data: MeetingMessage) => {
+    if (!mountedRef.current) return;
+
+    if (data.type === 'chat') {
+      // Add message immediately without waiting for state updates
+      const newMessage = {
+        id: data.id || `temp-${Date.now()}`,
+        sender: {
+          id: data.user_id || data.userId,
+          name: data.user_name || data.userName,
+          email: data.user_email || data.userEmail
+        },
+        content: data.message || data.data,
+        timestamp: new Date(data.timestamp!)
       };
-      
-      try {
-        ws.send(JSON.stringify(authMessage));
-      } catch (error) {
-        console.error('Failed to send auth message:', error);
-        cleanup();
-        return;
-      }
-
-      // Load chat history when WebSocket connects
-      loadChatHistory(false);
-    };
-
-    // Update the WebSocket message handler
-    ws.onmessage = (event) => {
-      if (!mountedRef.current) return;
-
-      try {
-        const data = JSON.parse(event.data);
-        
-        if (data.type === 'chat') {
-          // Add message immediately without waiting for state updates
-          const newMessage = {
-            id: data.id || `temp-${Date.now()}`,
-            sender: {
-              id: data.user_id || data.userId,
-              name: data.user_name || data.userName,
-              email: data.user_email || data.userEmail
-            },
-            content: data.message || data.data,
-            timestamp: new Date(data.timestamp)
-          };
-
-          // Use functional update to prevent race conditions
-          setMessages(prev => {
-            const isDuplicate = prev.some(msg => msg.id === newMessage.id);
-            if (isDuplicate) return prev;
-            
-            return [...prev, newMessage].sort((a, b) => 
-              a.timestamp.getTime() - b.timestamp.getTime()
-            );
-          });
-
-          // Immediate scroll for better UX
-          requestAnimationFrame(scrollToBottom);
-        }
-      } catch (error) {
-        console.error('Error handling WebSocket message:', error);
-      }
-    };
-
-    ws.onclose = (event) => {
-      clearTimeout(connectionTimeout);
-      console.log('WebSocket disconnected:', event.code, event.reason);
-      
-      if (mountedRef.current && event.code !== 1000) {
-        setWsConnected(false);
-        connectingRef.current = false;
-
-        if (reconnectAttempts < MAX_RECONNECT_ATTEMPTS) {
-          const delay = Math.min(1000 * Math.pow(2, reconnectAttempts), 10000);
-          console.log(`Reconnecting in ${delay}ms... (attempt ${reconnectAttempts + 1}/${MAX_RECONNECT_ATTEMPTS})`);
-          
-          if (reconnectTimeoutRef.current) {
-            clearTimeout(reconnectTimeoutRef.current);
-          }
-
-          reconnectTimeoutRef.current = setTimeout(() => {
-            if (mountedRef.current) {
-              setReconnectAttempts(prev => prev + 1);
-              initializeWebSocket();
-            }
-          }, delay);
-        }
-      }
-    };
 
-    ws.onerror = (error) => {
-      console.error('WebSocket error:', error);
-      cleanup();
-    };
+      // Use functional update to prevent race conditions
+      setMessages(prev => {
+        const isDuplicate = prev.some(msg => msg.id === newMessage.id);
+        if (isDuplicate) return prev;
 
-    // Keep-alive ping
-    const pingInterval = setInterval(() => {
-      if (ws.readyState === WebSocket.OPEN) {
-        try {
-          ws.send(JSON.stringify({ type: 'ping' }));
-        } catch (error) {
-          console.error('Failed to send ping:', error);
-          cleanup();
-        }
-      }
-    }, 30000);
+        return [...prev, newMessage].sort((a, b) =>
+          a.timestamp.getTime() - b.timestamp.getTime()
+        );
+      });
 
-    // Cleanup ping interval on close
-    ws.addEventListener('close', () => {
-      clearInterval(pingInterval);
-    });
+      // Immediate scroll for better UX
+      requestAnimationFrame(scrollToBottom);
+    }
+  }, [scrollToBottom]);
 
-  }, [meetingId, user, token, reconnectAttempts, cleanup, scrollToBottom]);
+  // Catch up on whatever was missed while the socket was down
+  const handleStatus = useCallback((connected: boolean) => {
+    if (!mountedRef.current) return;
+    setWsConnected(connected);
+    if (connected) {
+      loadChatHistory(false);
+    }
+  }, [loadChatHistory]);
 
-  // Initialize on component mount
+  // Subscribe on mount, after the initial history load
   useEffect(() => {
     mountedRef.current = true;
+    let unsubscribe: (() => void) | undefined;
 
-    // Load initial messages then connect WebSocket
     loadChatHistory().then(() => {
-      if (mountedRef.current) {
-        initializeWebSocket();
+      if (mountedRef.current && service) {
+        unsubscribe = service.subscribe(handleMessage, handleStatus);
       }
     });
 
     return () => {
       mountedRef.current = false;
-      cleanup();
+      unsubscribe?.();
     };
-  }, [meetingId, loadChatHistory, initializeWebSocket, cleanup]);
+  }, [meetingId, service, loadChatHistory, handleMessage, handleStatus]);
 
   // Scroll to bottom when messages change
   useEffect(() => {
@@ -292,7 +174,7 @@ const ChatPanel: React.FC<ChatPanelProps> = ({ meetingId, user, token, onClose }
   // Update sendMessage function to handle file uploads
   const sendMessage = async () => {
     if (!newMessage.trim() && !file) return;
-    if (!wsRef.current || wsRef.current.readyState !== WebSocket.OPEN) return;
+    if (!service?.isConnected()) return;
 
     setLoading(true);
     try {
@@ -304,17 +186,12 @@ const ChatPanel: React.FC<ChatPanelProps> = ({ meetingId, user, token, onClose }
         fileType = result.type;
       }
 
-      const message = {
+      service.send({
         type: 'chat',
         data: newMessage,
-        userId: user.id,
-        userName: user.name,
-        userEmail: user.email,
         meetingId,
         timestamp: new Date().toISOString()
-      };
-
-      wsRef.current.send(JSON.stringify(message));
+      });
       setNewMessage('');
       setFile(null);
     } catch (error) {
@@ -337,12 +214,6 @@ const ChatPanel: React.FC<ChatPanelProps> = ({ meetingId, user, token, onClose }
     loadChatHistory();
   };
 
-  const resetConnection = useCallback(() => {
-    setReconnectAttempts(0);
-    cleanup();
-    initializeWebSocket();
-  }, [cleanup, initializeWebSocket]);
-
   // Format time helper
   const formatTime = (timestamp: Date) => {
     return new Date(timestamp).toLocaleTimeString([], { 
@@ -433,10 +304,7 @@ const ChatPanel: React.FC<ChatPanelProps> = ({ meetingId, user, token, onClose }
           </Box>
           <Box display="flex" alignItems="center" gap={1}>
             <IconButton 
-              onClick={() => {
-                resetConnection();
-                handleRefresh();
-              }} 
+              onClick={handleRefresh} 
               size="small" 
               sx={{ color: '#fff' }}
               disabled={historyLoading}
@@ -474,10 +342,7 @@ const ChatPanel: React.FC<ChatPanelProps> = ({ meetingId, user, token, onClose }
             <Box display="flex" alignItems="center" gap={1}>
               <WifiOffIcon sx={{ color: 'error.light', fontSize: 16 }} />
               <Typography variant="caption" sx={{ color: 'error.light' }}>
-                {reconnectAttempts > 0 
-                  ? `Reconnecting... (${reconnectAttempts}/5)`
-                  : 'Connection lost. Reconnecting...'
-                }
+                Connection lost. Reconnecting...
               </Typography>
             </Box>
           </Box>
@@ -13,11 +13,13 @@ import ScreenShareIcon from '@mui/icons-material/ScreenShare';
 import StopScreenShareIcon from '@mui/icons-material/StopScreenShare';
 import ParticipantPanel from '../ParticipantPanel/ParticipantPanel';
 import ChatPanel from '../ChatPanel/ChatPanel';
+import WebRTCService from '../../services/WebRTCService';
 
 interface MeetingControlsProps {
   meetingId: string;
   user: User;
   token: string;
+  service: WebRTCService | null;
   onLeave: () => void;
   onToggleMic: () => void;
   onToggleVideo: () => void;
@@ -31,6 +33,7 @@ const MeetingControls: React.FC<MeetingControlsProps> = ({
   meetingId,
   user,
   token,
+  service,
   onLeave,
   onToggleMic,
   onToggleVideo,
@@ -110,6 +113,7 @@ const MeetingControls: React.FC<MeetingControlsProps> = ({
           meetingId={meetingId}
           user={user}
           token={token}
+          service={service}
           onClose={() => setShowChat(false)}
         />
       )}
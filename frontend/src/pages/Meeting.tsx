@@ -47,6 +47,8 @@ const Meeting: React.FC<MeetingProps> = ({ user, token }) => {
   const [meetingInfo, setMeetingInfo] = useState<any>(null);
   
   const webRTCServiceRef = useRef<WebRTCService | null>(null);
+  // Also kept in state so the chat panels re-render once it exists
+  const [webRTCService, setWebRTCService] = useState<WebRTCService | null>(null);
 
   useEffect(() => {
     initializeMeeting();
@@ -71,11 +73,13 @@ const Meeting: React.FC<MeetingProps> = ({ user, token }) => {
       // Initialize WebRTC service
       webRTCServiceRef.current = new WebRTCService(
         user,
+        token,
         meetingId!,
         onParticipantJoined,
         onParticipantLeft,
         onStreamReceived
       );
+      setWebRTCService(webRTCServiceRef.current);
 
       // Get user media
       const stream = await navigator.mediaDevices.getUserMedia({
@@ -239,6 +243,7 @@ const Meeting: React.FC<MeetingProps> = ({ user, token }) => {
             meetingId={meetingId!}
             user={user}
             token={token}
+            service={webRTCService}
             onClose={() => setIsChatOpen(false)}
           />
         )}
@@ -247,6 +252,7 @@ const Meeting: React.FC<MeetingProps> = ({ user, token }) => {
         meetingId={meetingId!}
         user={user}
         token={token}
+        service={webRTCService}
         onLeave={leaveMeeting}
         onToggleMic={toggleAudio}
         onToggleVideo={toggleVideo}
@@ -6,14 +6,59 @@ interface WebRTCServiceCallbacks {
   onStreamReceived: (participantId: string, stream: MediaStream) => void;
 }
 
+// Payload of a signaling frame, addressed to one peer through targetUserId
+interface SignalPayload {
+  type: 'offer' | 'answer' | 'candidate';
+  sdp?: string;
+  candidate?: RTCIceCandidateInit;
+}
+
+interface RosterEntry {
+  userId: string;
+  userName: string;
+}
+
+// A frame from the meeting socket, as the backend's WebSocketMessage
+export interface MeetingMessage {
+  type: string;
+  data?: any;
+  userId?: string;
+  userName?: string;
+  userEmail?: string;
+  meetingId?: string;
+  timestamp?: string;
+  id?: string;
+  [key: string]: any;
+}
+
+type MessageListener = (message: MeetingMessage) => void;
+type StatusListener = (connected: boolean) => void;
+
+const MAX_RECONNECT_ATTEMPTS = 5;
+const PING_INTERVAL = 30000;
+// Policy violation: the server removed us on purpose, so do not come back
+const CLOSE_POLICY_VIOLATION = 1008;
+
 export class WebRTCService {
   private peerConnections: Map<string, RTCPeerConnection>;
   private user: User;
+  private token: string;
   private meetingId: string;
   private callbacks: WebRTCServiceCallbacks;
+  private ws: WebSocket | null = null;
+  private localStream: MediaStream | null = null;
+  private iceServers: RTCIceServer[] = [];
+  // The server keeps one socket per user and meeting, so chat shares this one
+  private messageListeners = new Set<MessageListener>();
+  private statusListeners = new Set<StatusListener>();
+  private reconnectAttempts = 0;
+  private reconnectTimeout: ReturnType<typeof setTimeout> | null = null;
+  private pingInterval: ReturnType<typeof setInterval> | null = null;
+  private closing = false;
 
   constructor(
     user: User,
+    token: string,
     meetingId: string,
     onParticipantJoined: WebRTCServiceCallbacks['onParticipantJoined'],
     onParticipantLeft: WebRTCServiceCallbacks['onParticipantLeft'],
@@ -21,6 +66,7 @@ export class WebRTCService {
   ) {
     this.peerConnections = new Map();
     this.user = user;
+    this.token = token;
     this.meetingId = meetingId;
     this.callbacks = {
       onParticipantJoined,
@@ -30,46 +76,165 @@ export class WebRTCService {
   }
 
   async connect(localStream: MediaStream) {
-    // Initialize WebRTC connection
-    const ws = new WebSocket(`ws://localhost:8080/ws?meetingId=${this.meetingId}&userId=${this.user.id}`);
+    this.localStream = localStream;
+    this.iceServers = await this.fetchIceServers();
+    this.closing = false;
+    this.openSocket();
+  }
 
+  private openSocket() {
+    const ws = new WebSocket(`ws://localhost:8080/api/ws?meetingId=${encodeURIComponent(this.meetingId)}`);
+    this.ws = ws;
+
+    // The server takes the identity from the token, not from anything else we send
+    ws.onopen = () => {
+      ws.send(JSON.stringify({ type: 'auth', token: this.token }));
+      this.reconnectAttempts = 0;
+      this.pingInterval = setInterval(() => this.send({ type: 'ping' }), PING_INTERVAL);
+      this.statusListeners.forEach(listener => listener(true));
+    };
+
+    // The server batches queued messages into one frame, one JSON document
+    // per line; JSON never has a raw newline inside a document
     ws.onmessage = async (event) => {
-      const message = JSON.parse(event.data);
-      switch (message.type) {
-        case 'participant-joined':
-          this.handleParticipantJoined(message.userId, message.userName);
-          break;
-        case 'participant-left':
-          this.handleParticipantLeft(message.userId);
-          break;
-        case 'offer':
-          await this.handleOffer(message.userId, message.sdp);
-          break;
-        case 'answer':
-          await this.handleAnswer(message.userId, message.sdp);
-          break;
-        case 'ice-candidate':
-          await this.handleIceCandidate(message.userId, message.candidate);
-          break;
+      for (const line of String(event.data).split('\n')) {
+        if (!line.trim()) {
+          continue;
+        }
+        let message: MeetingMessage;
+        try {
+          message = JSON.parse(line);
+        } catch (error) {
+          console.error('Dropping malformed message:', error);
+          continue;
+        }
+        this.messageListeners.forEach(listener => listener(message));
+        await this.handleMessage(message);
       }
     };
 
-    // Add local stream tracks to peer connections
-    localStream.getTracks().forEach(track => {
-      this.peerConnections.forEach(pc => {
-        pc.addTrack(track, localStream);
+    ws.onclose = (event) => {
+      if (this.pingInterval) {
+        clearInterval(this.pingInterval);
+        this.pingInterval = null;
+      }
+      if (this.ws === ws) {
+        this.ws = null;
+      }
+      this.statusListeners.forEach(listener => listener(false));
+
+      if (this.closing || event.code === 1000 || event.code === CLOSE_POLICY_VIOLATION) {
+        return;
+      }
+      if (this.reconnectAttempts < MAX_RECONNECT_ATTEMPTS) {
+        const delay = Math.min(1000 * Math.pow(2, this.reconnectAttempts), 10000);
+        this.reconnectAttempts++;
+        this.reconnectTimeout = setTimeout(() => this.openSocket(), delay);
+      }
+    };
+  }
+
+  private async handleMessage(message: MeetingMessage) {
+    if (message.userId === this.user.id) {
+      return;
+    }
+    switch (message.type) {
+      case 'roster':
+        // Whoever joins last calls everyone already there
+        for (const entry of (message.data || []) as RosterEntry[]) {
+          if (entry.userId !== this.user.id) {
+            await this.callParticipant(entry.userId, entry.userName);
+          }
+        }
+        break;
+      case 'participant-joined':
+        this.handleParticipantJoined(message.userId!, message.userName!);
+        break;
+      case 'participant-left':
+        this.handleParticipantLeft(message.userId!);
+        break;
+      case 'signaling':
+        await this.handleSignal(message.userId!, message.userName!, message.data as SignalPayload);
+        break;
+      case 'error':
+        console.error('Signaling error:', message.data);
+        break;
+    }
+  }
+
+  // subscribe passes every frame of the meeting socket to onMessage, and
+  // whether it is connected to onStatus. It returns the unsubscribe function.
+  subscribe(onMessage: MessageListener, onStatus?: StatusListener): () => void {
+    this.messageListeners.add(onMessage);
+    if (onStatus) {
+      this.statusListeners.add(onStatus);
+      onStatus(this.isConnected());
+    }
+    return () => {
+      this.messageListeners.delete(onMessage);
+      if (onStatus) {
+        this.statusListeners.delete(onStatus);
+      }
+    };
+  }
+
+  isConnected(): boolean {
+    return this.ws?.readyState === WebSocket.OPEN;
+  }
+
+  // send writes a frame to the meeting socket, reporting false if it is down
+  send(message: MeetingMessage): boolean {
+    if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
+      return false;
+    }
+    this.ws.send(JSON.stringify(message));
+    return true;
+  }
+
+  // STUN and short-lived TURN credentials come from the backend
+  private async fetchIceServers(): Promise<RTCIceServer[]> {
+    try {
+      const response = await fetch('http://localhost:8080/api/ice-servers', {
+        headers: {
+          'Authorization': `Bearer ${this.token}`
+        }
       });
+      if (!response.ok) {
+        throw new Error(`ice-servers returned ${response.status}`);
+      }
+      const data = await response.json();
+      return (data.iceServers || []).map((server: any) => ({
+        urls: server.urls,
+        username: server.username,
+        credential: server.credential
+      }));
+    } catch (error) {
+      console.error('Failed to fetch ICE servers:', error);
+      return [];
+    }
+  }
+
+  private sendSignal(targetUserId: string, payload: SignalPayload) {
+    this.send({
+      type: 'signaling',
+      targetUserId,
+      data: payload
     });
   }
 
-  private async handleParticipantJoined(userId: string, userName: string) {
+  private createPeerConnection(userId: string, userName: string) {
+    const existing = this.peerConnections.get(userId);
+    if (existing) {
+      return existing;
+    }
+
     const pc = new RTCPeerConnection({
-      iceServers: [{ urls: 'stun:stun.l.google.com:19302' }]
+      iceServers: this.iceServers
     });
 
     pc.onicecandidate = (event) => {
       if (event.candidate) {
-        // Send ICE candidate to signaling server
+        this.sendSignal(userId, { type: 'candidate', candidate: event.candidate.toJSON() });
       }
     };
 
@@ -77,44 +242,65 @@ export class WebRTCService {
       this.callbacks.onStreamReceived(userId, event.streams[0]);
     };
 
+    this.localStream?.getTracks().forEach(track => {
+      pc.addTrack(track, this.localStream!);
+    });
+
     this.peerConnections.set(userId, pc);
     this.callbacks.onParticipantJoined({ id: userId, name: userName });
+    return pc;
   }
 
-  private handleParticipantLeft(userId: string) {
-    const pc = this.peerConnections.get(userId);
-    if (pc) {
-      pc.close();
-      this.peerConnections.delete(userId);
-    }
-    this.callbacks.onParticipantLeft(userId);
+  private async callParticipant(userId: string, userName: string) {
+    const pc = this.createPeerConnection(userId, userName);
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    this.sendSignal(userId, { type: 'offer', sdp: offer.sdp });
   }
 
-  private async handleOffer(userId: string, sdp: RTCSessionDescriptionInit) {
-    const pc = this.peerConnections.get(userId);
-    if (pc) {
-      await pc.setRemoteDescription(new RTCSessionDescription(sdp));
-      const answer = await pc.createAnswer();
-      await pc.setLocalDescription(answer);
-      // Send answer to signaling server
-    }
+  // A newcomer calls us, so just get ready for their offer
+  private handleParticipantJoined(userId: string, userName: string) {
+    this.createPeerConnection(userId, userName);
   }
 
-  private async handleAnswer(userId: string, sdp: RTCSessionDescriptionInit) {
+  private handleParticipantLeft(userId: string) {
     const pc = this.peerConnections.get(userId);
     if (pc) {
-      await pc.setRemoteDescription(new RTCSessionDescription(sdp));
+      pc.close();
+      this.peerConnections.delete(userId);
     }
+    this.callbacks.onParticipantLeft(userId);
   }
 
-  private async handleIceCandidate(userId: string, candidate: RTCIceCandidateInit) {
-    const pc = this.peerConnections.get(userId);
-    if (pc) {
-      await pc.addIceCandidate(new RTCIceCandidate(candidate));
+  private async handleSignal(userId: string, userName: string, payload: SignalPayload) {
+    switch (payload.type) {
+      case 'offer': {
+        const pc = this.createPeerConnection(userId, userName);
+        await pc.setRemoteDescription({ type: 'offer', sdp: payload.sdp });
+        const answer = await pc.createAnswer();
+        await pc.setLocalDescription(answer);
+        this.sendSignal(userId, { type: 'answer', sdp: answer.sdp });
+        break;
+      }
+      case 'answer': {
+        const pc = this.peerConnections.get(userId);
+        if (pc) {
+          await pc.setRemoteDescription({ type: 'answer', sdp: payload.sdp });
+        }
+        break;
+      }
+      case 'candidate': {
+        const pc = this.peerConnections.get(userId);
+        if (pc && payload.candidate) {
+          await pc.addIceCandidate(payload.candidate);
+        }
+        break;
+      }
     }
   }
 
   async replaceStream(newStream: MediaStream) {
+    this.localStream = newStream;
     this.peerConnections.forEach(pc => {
       const senders = pc.getSenders();
       senders.forEach(sender => {
@@ -129,9 +315,18 @@ export class WebRTCService {
   }
 
   disconnect() {
+    this.closing = true;
+    if (this.reconnectTimeout) {
+      clearTimeout(this.reconnectTimeout);
+      this.reconnectTimeout = null;
+    }
     this.peerConnections.forEach(pc => pc.close());
     this.peerConnections.clear();
+    this.ws?.close(1000, 'Leaving meeting');
+    this.ws = null;
+    this.messageListeners.clear();
+    this.statusListeners.clear();
   }
 }
 
-export default WebRTCService; 
\ No newline at end of file
+export default WebRTCService;